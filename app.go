@@ -2,52 +2,147 @@ package main
 
 import (
 	"context"
-	"crypto/sha256"
-	"encoding/hex"
 	"errors"
 	"fmt"
-	"io"
-	"io/fs"
 	"net"
-	"net/http"
 	"os"
 	"path/filepath"
 	"strings"
 	"time"
 
 	"github.com/nergy-se/wificonfig/pkg/ap"
-	"github.com/nergy-se/wificonfig/pkg/commands"
+	"github.com/nergy-se/wificonfig/pkg/jobs"
+	"github.com/nergy-se/wificonfig/pkg/netmon"
+	"github.com/nergy-se/wificonfig/pkg/network"
+	"github.com/nergy-se/wificonfig/pkg/state"
 	"github.com/nergy-se/wificonfig/pkg/webserver"
+	"github.com/nergy-se/wificonfig/pkg/wpa"
+	"github.com/nergy-se/wificonfig/pkg/wpaconf"
 	"github.com/sirupsen/logrus"
 	"github.com/urfave/cli/v2"
 )
 
+// WifiController manages wpa_supplicant.
+type WifiController interface {
+	StartWpaSupplicant(ctx context.Context) error
+	StopWpaSupplicant() error
+	WpaRunning() bool
+	WpaConnectedToWifi() (bool, error)
+	WpaIsAp() (bool, error)
+	WatchWpaEvents(ctx context.Context, fn func(*wpa.Event))
+	SelectAPChannel() (int, error)
+	StationChannel() (int, error)
+	SetAPPSK(psk string) error
+}
+
+// DHCPServer serves DHCP and DNS to clients of our AP. Implemented by ap.Dnsmasq and ap.BuiltinDHCP.
+type DHCPServer interface {
+	Start(ctx context.Context) error
+	Stop() error
+}
+
+// APController runs our AP on its own interface, used when the radio supports AP and station at the same time.
+// Implemented by ap.SupplicantAP and ap.Hostapd.
+type APController interface {
+	Start(ctx context.Context) error
+	Stop() error
+	IsUp() (bool, error)
+	SetChannel(channel int)
+	SetPSK(psk string)
+	WatchWpaEvents(ctx context.Context, fn func(*wpa.Event))
+}
+
+// ConnectJobs tells if a connection attempt started from the portal is running and how the last one went.
+// Implemented by jobs.Store.
+type ConnectJobs interface {
+	Running() bool
+	Last() (jobs.Job, bool)
+}
+
+// ConnectivityProber finds out if we have internet and through which interface.
+type ConnectivityProber interface {
+	Alive() (bool, error)
+	ActiveInterface() (string, error)
+	InterfaceWithIP(ip net.IP) (string, error)
+}
+
+// NetworkConfigWriter applies network interface configuration.
+type NetworkConfigWriter interface {
+	SyncStaticConfig() error
+	Reconfigure(iface string) error
+	SetAddress(iface, ip string) error
+}
+
 type App struct {
 	webserver *webserver.Webserver
-	ap        *ap.Ap
-
-	AliveURL                  string
-	EthernetInterfaceName     string
-	Interval                  time.Duration
-	IP                        string
-	wpaSupplicantConfigFile   string
-	apssid                    string
-	appsk                     string
-	wiredStaticConfigLocation string
+	wifi      WifiController
+	dhcp      DHCPServer
+	prober    ConnectivityProber
+	network   NetworkConfigWriter
+	jobs      ConnectJobs
+	// concurrentAP is nil when the AP and station share the wifi interface.
+	concurrentAP APController
+	// apChannels is how many channels the concurrent AP and the station may use together. With 1 the AP must
+	// follow the station, see followStation.
+	apChannels int
+	// apChannel is the channel the concurrent AP was last set to.
+	apChannel int
+
+	EthernetInterfaceName   string
+	WifiInterfaceName       string
+	APInterfaceName         string
+	Interval                time.Duration
+	NetlinkDebounce         time.Duration
+	IP                      string
+	wpaSupplicantConfigFile string
+	apssid                  string
+	appsk                   string
+	dataDir                 string
+	country                 *ap.Country
+	// countryFromFlag is set if --country was given explicitly and should override the config.
+	countryFromFlag bool
+	credentials     *ap.Credentials
+	// randomPSK gives every AP start a new passphrase and rotates it after provisioning, see startingAP.
+	randomPSK bool
+	// apStarted is set from the AP start until stopAP.
+	apStarted bool
+	// pskUsed is set when an AP has been started with the current passphrase.
+	pskUsed bool
+	// provisionedJob is the last successful connect job we rotated the passphrase for.
+	provisionedJob string
+
+	state   *state.Machine
+	trigger chan string
 }
 
-func NewApp(c *cli.Context, ws *webserver.Webserver, ap *ap.Ap) *App {
+// apGracePeriod is how long a concurrent AP is kept up after wifi came online so the portal can show the result.
+const apGracePeriod = time.Minute
+
+func NewApp(c *cli.Context, ws *webserver.Webserver, wifi WifiController, dhcp DHCPServer, sm *state.Machine, prober ConnectivityProber, country *ap.Country, credentials *ap.Credentials, jobs ConnectJobs) *App {
 	return &App{
-		webserver:                 ws,
-		ap:                        ap,
-		AliveURL:                  c.String("alive-url"),
-		Interval:                  c.Duration("check-interval"),
-		EthernetInterfaceName:     c.String("ethernet-interface"),
-		IP:                        c.String("ap-ip"),
-		apssid:                    c.String("ap-ssid"),
-		appsk:                     c.String("ap-psk"),
-		wpaSupplicantConfigFile:   c.String("wpa-supplicant-config"),
-		wiredStaticConfigLocation: c.String("wired-static-config-location"),
+		webserver:               ws,
+		wifi:                    wifi,
+		dhcp:                    dhcp,
+		jobs:                    jobs,
+		prober:                  prober,
+		network:                 network.NewSystemd(c.String("wired-static-config-location")),
+		state:                   sm,
+		Interval:                c.Duration("check-interval"),
+		NetlinkDebounce:         c.Duration("netlink-debounce"),
+		EthernetInterfaceName:   c.String("ethernet-interface"),
+		WifiInterfaceName:       c.String("wifi-interface"),
+		APInterfaceName:         c.String("wifi-interface"),
+		IP:                      c.String("ap-ip"),
+		apssid:                  c.String("ap-ssid"),
+		appsk:                   c.String("ap-psk"),
+		apChannel:               c.Int("ap-channel"),
+		credentials:             credentials,
+		randomPSK:               c.Bool("ap-random-psk"),
+		wpaSupplicantConfigFile: c.String("wpa-supplicant-config"),
+		dataDir:                 c.String("data-dir"),
+		country:                 country,
+		countryFromFlag:         c.IsSet("country"),
+		trigger:                 make(chan string, 1),
 	}
 }
 
@@ -63,7 +158,33 @@ func (a *App) Start(ctx context.Context) error {
 	if err != nil {
 		return err
 	}
+	if job, ok := a.jobs.Last(); ok { // jobs from before a restart are done with
+		a.provisionedJob = job.ID
+	}
+
+	err = a.ensureCountry()
+	if err != nil {
+		return err
+	}
+
+	err = a.state.Load(a.stateFile())
+	if err != nil {
+		logrus.Warnf("error loading state history: %s", err)
+	}
 
+	go a.wifi.WatchWpaEvents(ctx, a.handleWpaEvent)
+	if a.concurrentAP != nil {
+		go a.concurrentAP.WatchWpaEvents(ctx, a.handleWpaEvent)
+	}
+	go a.watchNetlink(ctx)
+	if a.credentials.Socket != "" {
+		go func() {
+			err := a.credentials.Serve(ctx)
+			if err != nil {
+				logrus.Errorf("AP credentials socket stopped: %s", err)
+			}
+		}()
+	}
 	go a.tickerLoop(ctx, a.Interval)
 
 	a.webserver.Start(ctx)
@@ -71,34 +192,70 @@ func (a *App) Start(ctx context.Context) error {
 	return nil
 }
 
+// ensureWpaConfig creates wpa_supplicant.conf if it is missing and makes sure our mode=2 AP network matches
+// --ap-ssid and --ap-psk. Only the AP block is rewritten, the client networks are left as they are.
 func (a *App) ensureWpaConfig() error {
-	_, err := os.Stat(a.wpaSupplicantConfigFile)
-	if err == nil {
-		return nil
-	}
+	changed := false
+	cfg, err := wpaconf.Load(a.wpaSupplicantConfigFile)
 	if errors.Is(err, os.ErrNotExist) {
-		f, err := os.OpenFile(a.wpaSupplicantConfigFile, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
-		if err != nil {
-			return err
-		}
-		_, err = io.WriteString(f, fmt.Sprintf(`ctrl_interface=/var/run/wpa_supplicant
+		changed = true
+		cfg, err = wpaconf.Parse(strings.NewReader(fmt.Sprintf(`ctrl_interface=/var/run/wpa_supplicant
 ctrl_interface_group=0
 update_config=1
-country=SE
+country=%s
 ap_scan=1
+`, a.country.Code())))
+	}
+	if err != nil {
+		return err
+	}
+
+	network := cfg.APNetwork()
+	if network == nil {
+		network = &wpaconf.Block{}
+		cfg.AddNetwork(network)
+		changed = true
+	}
+
+	settings := []struct{ key, value string }{
+		{"ssid", wpa.Quote(a.apssid)},
+		{"psk", wpa.QuotePassphrase(a.appsk)},
+		{"key_mgmt", "WPA-PSK"},
+		{"mode", "2"},
+	}
+	for _, s := range settings {
+		if value, _ := network.Get(s.key); value != s.value {
+			network.Set(s.key, s.value)
+			changed = true
+		}
+	}
+	if _, ok := network.Get("frequency"); !ok {
+		network.Set("frequency", "2437")
+		changed = true
+	}
 
-network={
-	ssid="%s"
-	psk="%s"
-	key_mgmt=WPA-PSK
-	mode=2
-	frequency=2437
+	if !changed {
+		return nil
+	}
+	logrus.Infof("writing AP network to %s", a.wpaSupplicantConfigFile)
+	return cfg.Save(a.wpaSupplicantConfigFile)
 }
-`, a.apssid, a.appsk))
-		return err
 
+// ensureCountry makes wpa_supplicant.conf and our country agree. An explicit --country wins, otherwise the
+// country in the config is kept so a change made from the portal survives restarts.
+func (a *App) ensureCountry() error {
+	current, err := ap.ConfigCountry(a.wpaSupplicantConfigFile)
+	if err != nil {
+		return err
 	}
-	return nil
+	if !a.countryFromFlag && ap.ValidCountry(current) {
+		return a.country.Set(current)
+	}
+	if current == a.country.Code() {
+		return nil
+	}
+	logrus.Infof("changing country in %s from %q to %s", a.wpaSupplicantConfigFile, current, a.country.Code())
+	return ap.SetConfigCountry(a.wpaSupplicantConfigFile, a.country.Code())
 }
 
 func (a *App) tickerLoop(ctx context.Context, d time.Duration) {
@@ -117,6 +274,14 @@ func (a *App) tickerLoop(ctx context.Context, d time.Duration) {
 				logrus.Error(err)
 			}
 
+		case reason := <-a.trigger:
+			logrus.Debugf("reconcile triggered by %s", reason)
+			err := a.reconcile(ctx)
+			if err != nil {
+				logrus.Error(err)
+			}
+			ticker.Reset(d)
+
 		case <-ctx.Done():
 			ticker.Stop()
 			return
@@ -124,201 +289,262 @@ func (a *App) tickerLoop(ctx context.Context, d time.Duration) {
 	}
 }
 
-func (a *App) syncStaticConfigIfNeeded() error {
-	if strings.HasPrefix(a.wiredStaticConfigLocation, "/etc/systemd/network") {
-		return nil // we already have config in correct location no need to sync it to /etc/systemd/network
-	}
-
-	dstFn := filepath.Join("/etc/systemd/network", filepath.Base(a.wiredStaticConfigLocation))
-
-	srcHash, err := hash(a.wiredStaticConfigLocation)
-	if err != nil {
-		if errors.Is(err, fs.ErrNotExist) { // if the config files does not exist we should remove the destination
-			err := os.Remove(dstFn)
-			if err != nil {
-				if errors.Is(err, fs.ErrNotExist) {
-					return nil // file is already removed
-				}
-				return err
-			}
-
-			_, err = commands.Run("networkctl", "reload")
-			return err
-		}
-		return err
-	}
-
-	dstHash, err := hash(dstFn)
-	if err != nil && !errors.Is(err, fs.ErrNotExist) {
-		return err
+// Trigger schedules a reconcile as soon as possible. Multiple triggers during a running reconcile are coalesced.
+func (a *App) Trigger(reason string) {
+	select {
+	case a.trigger <- reason:
+	default:
 	}
+}
 
-	if dstHash == srcHash {
-		return nil // nothing to do files are the same.
+func (a *App) handleWpaEvent(ev *wpa.Event) {
+	switch ev.Name {
+	case wpa.EventConnected, wpa.EventDisconnected, wpa.EventSSIDTempDisabled, wpa.EventAPEnabled:
+		logrus.Infof("wpa_supplicant event: %s", ev.Text)
+		a.Trigger(ev.Name)
+	default:
+		logrus.Debugf("wpa_supplicant event: %s", ev.Text)
 	}
+}
 
-	srcFile, err := os.Open(a.wiredStaticConfigLocation)
+func (a *App) watchNetlink(ctx context.Context) {
+	mon := netmon.New(a.EthernetInterfaceName, a.WifiInterfaceName, a.NetlinkDebounce)
+	err := mon.Run(ctx, func(reason string) {
+		logrus.Infof("network change: %s", reason)
+		a.Trigger(reason)
+	})
 	if err != nil {
-		return err
+		logrus.Errorf("netlink monitor stopped: %s", err)
 	}
-	defer srcFile.Close()
+}
 
-	dstFile, err := os.OpenFile(dstFn, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+func (a *App) reconcile(ctx context.Context) error {
+	obs, err := a.observe(ctx)
 	if err != nil {
 		return err
 	}
-	defer dstFile.Close()
 
-	_, err = io.Copy(dstFile, srcFile)
-	if err != nil {
-		return err
+	t, changed := a.state.Update(obs)
+	if changed {
+		logrus.Infof("state changed from %s to %s: %s", t.From, t.To, t.Reason)
+		err := a.state.Save(a.stateFile())
+		if err != nil {
+			logrus.Warnf("error saving state history: %s", err)
+		}
 	}
 
-	_, err = commands.Run("networkctl", "reload")
-	return err
+	return a.apply(ctx, changed)
 }
-func (a *App) reconcile(ctx context.Context) error {
-	alive, err := a.checkAlive()
+
+// observe collects what we need to decide the state. wpa_supplicant is started if ethernet is not online
+// since we cannot ask it about wifi otherwise.
+func (a *App) observe(ctx context.Context) (state.Observation, error) {
+	obs := state.Observation{}
+
+	alive, err := a.prober.Alive()
 	if err != nil {
 		logrus.Error(fmt.Errorf("error checking alive: %w", err))
 	}
+	obs.Alive = alive
 
-	err = a.syncStaticConfigIfNeeded()
+	err = a.network.SyncStaticConfig()
 	if err != nil {
 		logrus.Warn(err)
 	}
 
-	activeInt, _, err := GetActiveInterface()
+	activeInt, err := a.prober.ActiveInterface()
 	if err != nil {
-		return err
+		return obs, err
 	}
+	obs.EthernetActive = activeInt == a.EthernetInterfaceName
 
-	if alive && activeInt != nil && activeInt.Name == a.EthernetInterfaceName { // ethernet connected and alive
-		err := a.ap.StopDnsmasq()
-		if err != nil {
-			return err
-		}
-		err = a.ap.StopWpaSupplicant()
-		if err != nil {
-			return err
-		}
-
-		return nil
+	if obs.Alive && obs.EthernetActive {
+		return obs, nil
 	}
 
 	// no ethernet connection detected so lets make sure wpa_supplicant is running
-	err = a.ap.StartWpaSupplicant(ctx)
+	err = a.wifi.StartWpaSupplicant(ctx)
 	if err != nil {
-		return err
+		return obs, err
 	}
 
-	isConnectedWifi, err := a.ap.WpaConnectedToWifi()
+	obs.WifiConnected, err = a.wifi.WpaConnectedToWifi()
 	if err != nil {
-		return err
+		return obs, err
+	}
+	if obs.WifiConnected {
+		return obs, nil
 	}
 
-	if isConnectedWifi { // we are connectd to wifi station.
-		err := a.ap.StopDnsmasq()
+	if a.concurrentAP != nil {
+		obs.APActive, err = a.concurrentAP.IsUp()
+		return obs, err
+	}
+	obs.APActive, err = a.wifi.WpaIsAp()
+	return obs, err
+}
+
+// apply makes sure the services match the current state. entered is true if we just transitioned to it.
+func (a *App) apply(ctx context.Context, entered bool) error {
+	current, since := a.state.State()
+	switch current {
+	case state.EthernetOnline:
+		err := a.stopAP()
 		if err != nil {
 			return err
 		}
+		return a.wifi.StopWpaSupplicant()
 
-		if int, _, err := InterfaceHasIP(net.ParseIP(a.IP)); int != nil && err == nil && int.Name == "wlan0" { // if we have our AP ip lets restart the network to get DHCP.
-			_, err = commands.Run("networkctl", "reconfigure", "wlan0")
-			return err
+	case state.WifiOnline:
+		if a.concurrentAP == nil || time.Since(since) >= apGracePeriod {
+			err := a.stopAP()
+			if err != nil {
+				return err
+			}
+		} else if err := a.followStation(); err != nil {
+			logrus.Warnf("error following station channel: %s", err)
 		}
-		return nil
-	}
 
-	// no wifi or ethernet lets be AP and DHCP
-
-	isAP, err := a.ap.WpaIsAp()
-
-	if err != nil {
-		return err
-	}
+		if int, err := a.prober.InterfaceWithIP(net.ParseIP(a.IP)); err == nil && int == a.WifiInterfaceName { // if we have our AP ip lets restart the network to get DHCP.
+			return a.network.Reconfigure(a.WifiInterfaceName)
+		}
+		return nil
 
-	if isAP {
-		err = a.ap.StartDnsmasq(ctx)
+	case state.APFallback: // no wifi or ethernet lets be AP and DHCP
+		err := a.startingAP()
 		if err != nil {
 			return err
 		}
-		_, err = commands.Run("ifconfig", "wlan0", a.IP)
-		return err
+		err = a.dhcp.Start(ctx)
+		if err != nil {
+			return err
+		}
+		return a.network.SetAddress(a.APInterfaceName, a.IP)
+
+	case state.WifiConnecting:
+		// pick the AP channel while we are still able to scan. A single channel AP follows the station instead and
+		// we must not scan while a connect job is associating.
+		if entered && a.apChannels != 1 && !a.jobs.Running() {
+			channel, err := a.wifi.SelectAPChannel()
+			if err != nil {
+				logrus.Warnf("error selecting AP channel: %s", err)
+			}
+			if a.concurrentAP != nil && channel != 0 {
+				a.concurrentAP.SetChannel(channel)
+				a.apChannel = channel
+			}
+		}
+		if a.concurrentAP != nil { // keep the portal available while the station is connecting.
+			err := a.followStation()
+			if err != nil {
+				logrus.Warnf("error following station channel: %s", err)
+			}
+			err = a.startingAP()
+			if err != nil {
+				return err
+			}
+			return a.concurrentAP.Start(ctx)
+		}
+
+	case state.Degraded:
+		if entered && a.wifi.WpaRunning() {
+			logrus.Warn("wpa_supplicant is neither connected nor AP, restarting it")
+			return a.wifi.StopWpaSupplicant() // it will be started again on next reconcile
+		}
 	}
 
 	return nil
 }
 
-func GetActiveInterface() (*net.Interface, net.IP, error) {
-	outboundIP, err := GetOutboundIP()
-	if err != nil {
-		return nil, nil, nil // we ignore if we get for example connect: network is unreachable
+// followStation moves the concurrent AP to the channel of the station on radios where both must use the same
+// channel. An AP running on another channel is stopped, the next Start uses the new one.
+func (a *App) followStation() error {
+	if a.apChannels != 1 {
+		return nil
+	}
+	channel, err := a.wifi.StationChannel()
+	if err != nil || channel == 0 || channel == a.apChannel {
+		return err
 	}
-	return InterfaceHasIP(outboundIP)
+	logrus.Infof("moving AP from channel %d to channel %d of the station", a.apChannel, channel)
+	a.concurrentAP.SetChannel(channel)
+	a.apChannel = channel
+	return a.concurrentAP.Stop()
 }
 
-func InterfaceHasIP(expectedIP net.IP) (*net.Interface, net.IP, error) {
-	interfaces, err := net.Interfaces()
+// stopAP stops DHCP and the concurrent AP if we have one. In single mode wpa_supplicant stops the AP by itself.
+// With --ap-random-psk the passphrase is rotated if a connect job succeeded while the AP was up.
+func (a *App) stopAP() error {
+	err := a.dhcp.Stop()
 	if err != nil {
-		return nil, nil, err
+		return err
 	}
-	for _, i := range interfaces {
-		addrs, err := i.Addrs()
+	if a.concurrentAP != nil {
+		err = a.concurrentAP.Stop()
 		if err != nil {
-			return nil, nil, err
-		}
-		for _, a := range addrs {
-			ip, _, err := net.ParseCIDR(a.String())
-			if err != nil {
-				return nil, nil, err
-			}
-			if ip.Equal(expectedIP) {
-				return &i, ip, nil
-			}
+			return err
 		}
 	}
-	return nil, nil, fmt.Errorf("found no interface")
-
+	if !a.apStarted {
+		return nil
+	}
+	a.apStarted = false
+	if a.randomPSK && a.provisioned() {
+		return a.rotatePSK()
+	}
+	return nil
 }
 
-func GetOutboundIP() (net.IP, error) {
-	conn, err := net.Dial("udp", "8.8.8.8:80")
-	if err != nil {
-		return nil, err
+// startingAP is called before the concurrent AP starts, or in single mode when wpa_supplicant has started it.
+// With --ap-random-psk an AP never starts with a passphrase an earlier AP has used, a new one is generated.
+func (a *App) startingAP() error {
+	if a.apStarted {
+		return nil
 	}
-	defer conn.Close()
-
-	localAddr := conn.LocalAddr().(*net.UDPAddr)
-
-	return localAddr.IP, nil
+	a.apStarted = true
+	if !a.randomPSK {
+		return nil
+	}
+	if a.pskUsed {
+		err := a.rotatePSK()
+		if err != nil {
+			return err
+		}
+	}
+	a.pskUsed = true
+	return nil
 }
 
-var aliveClient = &http.Client{
-	Timeout: time.Second * 10,
+// provisioned reports if a connect job succeeded that we have not rotated the passphrase for yet.
+func (a *App) provisioned() bool {
+	job, ok := a.jobs.Last()
+	if !ok || job.Phase != jobs.PhaseDone || job.ID == a.provisionedJob {
+		return false
+	}
+	a.provisionedJob = job.ID
+	return true
 }
 
-func (a *App) checkAlive() (bool, error) {
-	r, err := aliveClient.Get(a.AliveURL)
+// rotatePSK replaces the AP passphrase with a new random one, so a passphrase shown on an earlier AP or during
+// provisioning cannot be used to reach the portal later. A running single mode AP is restarted with it.
+func (a *App) rotatePSK() error {
+	psk, err := ap.GeneratePassphrase()
 	if err != nil {
-		return false, err
+		return err
 	}
-
-	return r.StatusCode == 200, nil
-}
-
-func hash(r string) (string, error) {
-	h := sha256.New()
-
-	f, err := os.Open(r)
+	logrus.Info("rotating AP passphrase")
+	a.appsk = psk
+	a.pskUsed = false
+	if a.concurrentAP != nil {
+		a.concurrentAP.SetPSK(psk)
+	}
+	err = a.wifi.SetAPPSK(psk)
 	if err != nil {
-		return "", err
+		return err
 	}
-	defer f.Close()
+	return a.credentials.SetPSK(psk)
+}
 
-	if _, err := io.Copy(h, f); err != nil {
-		return "", err
-	}
-	sum := hex.EncodeToString(h.Sum(nil))
-	return sum, nil
+func (a *App) stateFile() string {
+	return filepath.Join(a.dataDir, "state.json")
 }
@@ -0,0 +1,521 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nergy-se/wificonfig/pkg/ap"
+	"github.com/nergy-se/wificonfig/pkg/fake"
+	"github.com/nergy-se/wificonfig/pkg/jobs"
+	"github.com/nergy-se/wificonfig/pkg/state"
+)
+
+type fakes struct {
+	wifi    *fake.Wifi
+	dhcp    *fake.DHCP
+	prober  *fake.Prober
+	network *fake.Network
+}
+
+func newTestApp(t *testing.T, f fakes) *App {
+	return &App{
+		wifi:                  f.wifi,
+		dhcp:                  f.dhcp,
+		prober:                f.prober,
+		network:               f.network,
+		jobs:                  jobs.NewStore(filepath.Join(t.TempDir(), "jobs.json")),
+		EthernetInterfaceName: "end0",
+		WifiInterfaceName:     "wlan0",
+		APInterfaceName:       "wlan0",
+		IP:                    "192.168.27.1",
+		dataDir:               t.TempDir(),
+		credentials:           &ap.Credentials{},
+		state:                 state.New(time.Minute),
+		trigger:               make(chan string, 1),
+	}
+}
+
+func TestReconcile(t *testing.T) {
+	statusErr := errors.New("wpa_supplicant control socket not found")
+
+	tests := []struct {
+		name            string
+		f               fakes
+		expectedErr     error
+		expectedState   state.State
+		wifiRunning     bool
+		dhcpRunning     bool
+		expectedNetwork []string
+	}{
+		{
+			name: "ethernet up",
+			f: fakes{
+				wifi:    &fake.Wifi{Running: true},
+				dhcp:    &fake.DHCP{Running: true},
+				prober:  &fake.Prober{AliveResult: true, Active: "end0"},
+				network: &fake.Network{},
+			},
+			expectedState: state.EthernetOnline,
+		},
+		{
+			name: "ethernet up but not alive",
+			f: fakes{
+				wifi:    &fake.Wifi{AP: true},
+				dhcp:    &fake.DHCP{},
+				prober:  &fake.Prober{Active: "end0"},
+				network: &fake.Network{},
+			},
+			expectedState:   state.APFallback,
+			wifiRunning:     true,
+			dhcpRunning:     true,
+			expectedNetwork: []string{"SetAddress wlan0 192.168.27.1"},
+		},
+		{
+			name: "wifi up",
+			f: fakes{
+				wifi:    &fake.Wifi{Connected: true},
+				dhcp:    &fake.DHCP{Running: true},
+				prober:  &fake.Prober{AliveResult: true, Active: "wlan0"},
+				network: &fake.Network{},
+			},
+			expectedState: state.WifiOnline,
+			wifiRunning:   true,
+		},
+		{
+			name: "wifi up with AP address still configured",
+			f: fakes{
+				wifi:    &fake.Wifi{Connected: true},
+				dhcp:    &fake.DHCP{},
+				prober:  &fake.Prober{InterfaceWithIPs: map[string]string{"192.168.27.1": "wlan0"}},
+				network: &fake.Network{},
+			},
+			expectedState:   state.WifiOnline,
+			wifiRunning:     true,
+			expectedNetwork: []string{"Reconfigure wlan0"},
+		},
+		{
+			name: "AP fallback",
+			f: fakes{
+				wifi:    &fake.Wifi{AP: true},
+				dhcp:    &fake.DHCP{},
+				prober:  &fake.Prober{},
+				network: &fake.Network{},
+			},
+			expectedState:   state.APFallback,
+			wifiRunning:     true,
+			dhcpRunning:     true,
+			expectedNetwork: []string{"SetAddress wlan0 192.168.27.1"},
+		},
+		{
+			name: "alive check error is not fatal",
+			f: fakes{
+				wifi:    &fake.Wifi{AP: true},
+				dhcp:    &fake.DHCP{},
+				prober:  &fake.Prober{AliveErr: errors.New("timeout")},
+				network: &fake.Network{SyncErr: errors.New("permission denied")},
+			},
+			expectedState:   state.APFallback,
+			wifiRunning:     true,
+			dhcpRunning:     true,
+			expectedNetwork: []string{"SetAddress wlan0 192.168.27.1"},
+		},
+		{
+			name: "wpa_supplicant fails to start",
+			f: fakes{
+				wifi:    &fake.Wifi{StartErr: errors.New("exec: wpa_supplicant not found")},
+				dhcp:    &fake.DHCP{},
+				prober:  &fake.Prober{},
+				network: &fake.Network{},
+			},
+			expectedErr:   errors.New("exec: wpa_supplicant not found"),
+			expectedState: state.Unknown,
+		},
+		{
+			name: "wpa_supplicant status error",
+			f: fakes{
+				wifi:    &fake.Wifi{StatusErr: statusErr},
+				dhcp:    &fake.DHCP{},
+				prober:  &fake.Prober{},
+				network: &fake.Network{},
+			},
+			expectedErr:   statusErr,
+			expectedState: state.Unknown,
+			wifiRunning:   true,
+		},
+		{
+			name: "DHCP server fails to start",
+			f: fakes{
+				wifi:    &fake.Wifi{AP: true},
+				dhcp:    &fake.DHCP{StartErr: errors.New("address in use")},
+				prober:  &fake.Prober{},
+				network: &fake.Network{},
+			},
+			expectedErr:   errors.New("address in use"),
+			expectedState: state.APFallback,
+			wifiRunning:   true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := newTestApp(t, tt.f)
+
+			err := a.reconcile(context.Background())
+			if tt.expectedErr == nil && err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if tt.expectedErr != nil && (err == nil || err.Error() != tt.expectedErr.Error()) {
+				t.Fatalf("expected error %s got %v", tt.expectedErr, err)
+			}
+
+			current, _ := a.state.State()
+			if current != tt.expectedState {
+				t.Errorf("expected state %s got %s", tt.expectedState, current)
+			}
+			if tt.f.wifi.Running != tt.wifiRunning {
+				t.Errorf("expected wpa_supplicant running %t got %t", tt.wifiRunning, tt.f.wifi.Running)
+			}
+			if tt.f.dhcp.Running != tt.dhcpRunning {
+				t.Errorf("expected dhcp running %t got %t", tt.dhcpRunning, tt.f.dhcp.Running)
+			}
+			if !slices.Equal(tt.f.network.Calls, tt.expectedNetwork) {
+				t.Errorf("expected network calls %v got %v", tt.expectedNetwork, tt.f.network.Calls)
+			}
+		})
+	}
+}
+
+func TestReconcileRestartsStuckWpaSupplicant(t *testing.T) {
+	f := fakes{
+		wifi:    &fake.Wifi{},
+		dhcp:    &fake.DHCP{},
+		prober:  &fake.Prober{},
+		network: &fake.Network{},
+	}
+	a := newTestApp(t, f)
+	a.state = state.New(0)
+	a.state.Timeouts[state.WifiConnecting] = state.Timeout{After: time.Nanosecond, To: state.Degraded}
+
+	ctx := context.Background()
+	err := a.reconcile(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond)
+	err = a.reconcile(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	current, _ := a.state.State()
+	if current != state.Degraded {
+		t.Fatalf("expected %s got %s", state.Degraded, current)
+	}
+	if !slices.Equal(f.wifi.Calls, []string{"StartWpaSupplicant", "SelectAPChannel", "StartWpaSupplicant", "StopWpaSupplicant"}) {
+		t.Errorf("expected wpa_supplicant to be restarted got calls %v", f.wifi.Calls)
+	}
+}
+
+func TestReconcileConcurrentAP(t *testing.T) {
+	f := fakes{
+		wifi:    &fake.Wifi{Channel: 11},
+		dhcp:    &fake.DHCP{},
+		prober:  &fake.Prober{},
+		network: &fake.Network{},
+	}
+	a := newTestApp(t, f)
+	ap := &fake.AP{Up: true}
+	a.concurrentAP = ap
+	a.APInterfaceName = "uap0"
+
+	ctx := context.Background()
+	err := a.reconcile(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	current, _ := a.state.State()
+	if current != state.WifiConnecting || !ap.Running {
+		t.Fatalf("expected AP to be started while connecting, state %s running %t", current, ap.Running)
+	}
+	if ap.Channel != 11 {
+		t.Errorf("expected AP on selected channel 11 got %d", ap.Channel)
+	}
+
+	err = a.reconcile(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	current, _ = a.state.State()
+	if current != state.APFallback || !f.dhcp.Running {
+		t.Fatalf("expected AP fallback with DHCP, state %s dhcp %t", current, f.dhcp.Running)
+	}
+	if !slices.Equal(f.network.Calls, []string{"SetAddress uap0 192.168.27.1"}) {
+		t.Errorf("expected AP address on uap0 got %v", f.network.Calls)
+	}
+
+	f.wifi.Connected = true
+	err = a.reconcile(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	current, _ = a.state.State()
+	if current != state.WifiOnline || !ap.Running || !f.dhcp.Running {
+		t.Fatalf("expected AP to stay up after connecting, state %s running %t dhcp %t", current, ap.Running, f.dhcp.Running)
+	}
+	if f.wifi.Calls[len(f.wifi.Calls)-1] == "StopWpaSupplicant" {
+		t.Errorf("station wpa_supplicant should not be stopped")
+	}
+}
+
+func TestReconcileSingleChannelAPFollowsStation(t *testing.T) {
+	f := fakes{
+		wifi:    &fake.Wifi{Channel: 11, StationChannelResult: 36},
+		dhcp:    &fake.DHCP{},
+		prober:  &fake.Prober{},
+		network: &fake.Network{},
+	}
+	a := newTestApp(t, f)
+	ap := &fake.AP{Up: true}
+	a.concurrentAP = ap
+	a.apChannels = 1
+	a.apChannel = 6
+
+	ctx := context.Background()
+	err := a.reconcile(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ap.Channel != 36 || !ap.Running {
+		t.Fatalf("expected AP started on station channel 36 got %d running %t", ap.Channel, ap.Running)
+	}
+	if slices.Contains(f.wifi.Calls, "SelectAPChannel") {
+		t.Errorf("expected no channel selection for a single channel AP")
+	}
+
+	f.wifi.StationChannelResult = 1
+	f.wifi.Connected = true
+	err = a.reconcile(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ap.Channel != 1 || ap.Running {
+		t.Errorf("expected AP stopped to move to channel 1 got %d running %t", ap.Channel, ap.Running)
+	}
+}
+
+func TestReconcileNoChannelScanDuringJob(t *testing.T) {
+	f := fakes{
+		wifi:    &fake.Wifi{Channel: 11},
+		dhcp:    &fake.DHCP{},
+		prober:  &fake.Prober{},
+		network: &fake.Network{},
+	}
+	a := newTestApp(t, f)
+	ap := &fake.AP{Up: true}
+	a.concurrentAP = ap
+	a.apChannels = 2
+	store := jobs.NewStore(filepath.Join(t.TempDir(), "jobs.json"))
+	_, err := store.New("house")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.jobs = store
+
+	err = a.reconcile(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	current, _ := a.state.State()
+	if current != state.WifiConnecting || !ap.Running {
+		t.Fatalf("expected AP to be started while connecting, state %s running %t", current, ap.Running)
+	}
+	if slices.Contains(f.wifi.Calls, "SelectAPChannel") {
+		t.Errorf("expected no channel scan while a connect job is running")
+	}
+}
+
+func TestReconcileRandomPSKOnAPStart(t *testing.T) {
+	f := fakes{
+		wifi:    &fake.Wifi{AP: true},
+		dhcp:    &fake.DHCP{},
+		prober:  &fake.Prober{},
+		network: &fake.Network{},
+	}
+	a := newTestApp(t, f)
+	a.randomPSK = true
+	a.appsk = "boot-psk"
+	a.credentials = &ap.Credentials{File: filepath.Join(t.TempDir(), "ap-psk")}
+
+	ctx := context.Background()
+	err := a.reconcile(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if slices.Contains(f.wifi.Calls, "SetAPPSK") {
+		t.Fatalf("the first AP should use the passphrase generated at boot")
+	}
+
+	// wifi comes back without anything provisioned through the portal.
+	f.wifi.AP = false
+	f.wifi.Connected = true
+	err = a.reconcile(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if slices.Contains(f.wifi.Calls, "SetAPPSK") {
+		t.Fatalf("passphrase should not be rotated without a successful connect job")
+	}
+
+	f.wifi.AP = true
+	f.wifi.Connected = false
+	err = a.reconcile(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.wifi.PSK == "" || f.wifi.PSK == "boot-psk" || a.appsk != f.wifi.PSK {
+		t.Fatalf("expected a new passphrase when the AP starts again got %q", f.wifi.PSK)
+	}
+	data, err := os.ReadFile(a.credentials.File)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), "psk="+f.wifi.PSK+"\n") {
+		t.Errorf("expected new passphrase to be published got %q", data)
+	}
+
+	generated := f.wifi.PSK
+	err = a.reconcile(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.wifi.PSK != generated {
+		t.Errorf("passphrase should not change while the AP is up")
+	}
+}
+
+func TestReconcileRotatesRandomPSKAfterProvisioning(t *testing.T) {
+	f := fakes{
+		wifi:    &fake.Wifi{AP: true},
+		dhcp:    &fake.DHCP{},
+		prober:  &fake.Prober{},
+		network: &fake.Network{},
+	}
+	a := newTestApp(t, f)
+	store := jobs.NewStore(filepath.Join(t.TempDir(), "jobs.json"))
+	a.jobs = store
+	a.randomPSK = true
+	a.appsk = "boot-psk"
+
+	ctx := context.Background()
+	err := a.reconcile(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	failed, err := store.New("house")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store.Finish(failed.ID, errors.New("wrong password"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	job, err := store.New("house")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store.Finish(job.ID, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f.wifi.AP = false
+	f.wifi.Connected = true
+	err = a.reconcile(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.wifi.PSK == "" || f.wifi.PSK == "boot-psk" || a.appsk != f.wifi.PSK {
+		t.Fatalf("expected a new passphrase after provisioning got %q", f.wifi.PSK)
+	}
+
+	// the AP starting again uses the passphrase rotated after provisioning since no AP has used it yet.
+	rotated := f.wifi.PSK
+	f.wifi.AP = true
+	f.wifi.Connected = false
+	err = a.reconcile(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.wifi.AP = false
+	f.wifi.Connected = true
+	err = a.reconcile(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.wifi.PSK != rotated {
+		t.Errorf("passphrase should only be rotated once for a connect job")
+	}
+}
+
+func TestEnsureWpaConfig(t *testing.T) {
+	a := newTestApp(t, fakes{})
+	a.wpaSupplicantConfigFile = filepath.Join(t.TempDir(), "wpa_supplicant.conf")
+	a.country = &ap.Country{}
+	err := a.country.Set("SE")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.apssid = "old-setup"
+	a.appsk = "secret123"
+
+	err = a.ensureWpaConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := "\nnetwork={\n\tssid=\"house\"\n\tpsk=\"password\"\n\tpriority=11\n}\n"
+	f, err := os.OpenFile(a.wpaSupplicantConfigFile, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.WriteString(client)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a.apssid = "new-setup"
+	err = a.ensureWpaConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(a.wpaSupplicantConfigFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `ctrl_interface=/var/run/wpa_supplicant
+ctrl_interface_group=0
+update_config=1
+country=SE
+ap_scan=1
+
+network={
+	ssid="new-setup"
+	psk="secret123"
+	key_mgmt=WPA-PSK
+	mode=2
+	frequency=2437
+}
+` + client
+	if string(data) != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, data)
+	}
+}
@@ -3,13 +3,19 @@ package main
 import (
 	"context"
 	"fmt"
+	"net/url"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"strings"
 	"syscall"
 	"time"
 
 	"github.com/nergy-se/wificonfig/pkg/ap"
+	"github.com/nergy-se/wificonfig/pkg/captive"
+	"github.com/nergy-se/wificonfig/pkg/jobs"
+	"github.com/nergy-se/wificonfig/pkg/network"
+	"github.com/nergy-se/wificonfig/pkg/state"
 	"github.com/nergy-se/wificonfig/pkg/webserver"
 	"github.com/sirupsen/logrus"
 	"github.com/urfave/cli/v2"
@@ -53,6 +59,14 @@ func app() *cli.App {
 			Value: "8080",
 			Usage: "webserver listen port",
 		},
+		&cli.StringFlag{
+			Name:  "portal-port",
+			Usage: "also serve the portal on this port, usually 80 so captive portal probes and browsers reach it when --listen-port is something else",
+		},
+		&cli.StringFlag{
+			Name:  "captive-api-url",
+			Usage: "https URL where clients reach /api/captive-v1, for example through a TLS proxy. Sent in DHCP option 114, which is left out without it since clients ignore http URLs",
+		},
 		&cli.StringFlag{
 			Name:  "wpa-supplicant-config",
 			Value: "/etc/wpa_supplicant.conf",
@@ -63,6 +77,11 @@ func app() *cli.App {
 			Value: "/etc/systemd/network/10-wificonfig-wired.network",
 			Usage: "config where to save static ethernet interface config when configured using the web portal",
 		},
+		&cli.StringFlag{
+			Name:  "country",
+			Value: "SE",
+			Usage: "ISO 3166-1 alpha-2 regulatory country. When set it overrides the country in wpa_supplicant.conf, otherwise the country from the config is kept",
+		},
 		&cli.StringFlag{
 			Name:  "ap-ip",
 			Value: "192.168.27.1",
@@ -71,12 +90,24 @@ func app() *cli.App {
 		&cli.StringFlag{
 			Name:  "ap-ssid",
 			Value: "",
-			Usage: "ssid of the AP",
+			Usage: "ssid of the AP, may contain {mac}, {hostname}, {machine-id} and {serial} with an optional length like {mac4}",
 		},
 		&cli.StringFlag{
 			Name:  "ap-psk",
 			Value: "",
-			Usage: "password of the AP",
+			Usage: "password of the AP, supports the same placeholders as --ap-ssid",
+		},
+		&cli.BoolFlag{
+			Name:  "ap-random-psk",
+			Usage: "ignore --ap-psk and use a random password, new every time the AP starts and rotated after a successful connect from the portal",
+		},
+		&cli.StringFlag{
+			Name:  "ap-psk-file",
+			Usage: "write the AP ssid, password and a WIFI: QR payload to this file whenever the password changes",
+		},
+		&cli.StringFlag{
+			Name:  "ap-psk-socket",
+			Usage: "unix socket answering every connection with the AP ssid, password and a WIFI: QR payload",
 		},
 		&cli.StringFlag{
 			Name:  "dhcp-start",
@@ -88,28 +119,303 @@ func app() *cli.App {
 			Value: "192.168.27.150",
 			Usage: "dhcp end address",
 		},
+		&cli.StringFlag{
+			Name:  "dhcp-backend",
+			Value: "dnsmasq",
+			Usage: "what serves DHCP and DNS to AP clients, dnsmasq or builtin which runs in process without a dnsmasq binary",
+		},
 		&cli.StringFlag{
 			Name:  "ethernet-interface",
 			Value: "end0",
 			Usage: "ethernet interface name",
 		},
+		&cli.StringFlag{
+			Name:  "wifi-interface",
+			Usage: "wireless interface name, defaults to the first wireless interface found in /sys/class/net",
+		},
+		&cli.StringFlag{
+			Name:  "ap-interface",
+			Value: "uap0",
+			Usage: "virtual interface created for the AP when running AP and station concurrently",
+		},
+		&cli.BoolFlag{
+			Name:  "concurrent-ap",
+			Value: true,
+			Usage: "run the AP on --ap-interface next to the station if the radio supports it",
+		},
+		&cli.StringFlag{
+			Name:  "ap-backend",
+			Value: "wpa_supplicant",
+			Usage: "what runs the AP, wpa_supplicant or hostapd. hostapd requires --concurrent-ap and a radio supporting it, single mode where the AP takes over the wifi interface is only supported by wpa_supplicant",
+		},
+		&cli.StringFlag{
+			Name:  "ap-band",
+			Value: ap.Band24GHz,
+			Usage: "AP band, 2.4GHz or 5GHz",
+		},
+		&cli.IntFlag{
+			Name:  "ap-channel",
+			Value: 6,
+			Usage: "AP channel, preferred on ties when --ap-auto-channel is enabled",
+		},
+		&cli.BoolFlag{
+			Name:  "ap-auto-channel",
+			Value: true,
+			Usage: "scan before starting the AP and use the least busy of channel 1, 6 and 11 (on 5GHz the non-DFS channels the country allows)",
+		},
+		&cli.StringFlag{
+			Name:  "ap-hw-mode",
+			Usage: "hostapd hw_mode, defaults to g for 2.4GHz and a for 5GHz",
+		},
+		&cli.IntFlag{
+			Name:  "ap-channel-width",
+			Value: 20,
+			Usage: "hostapd channel width in MHz, 20, 40 or 80 (5GHz only). Narrower if a selected channel does not support it",
+		},
+		&cli.IntFlag{
+			Name:  "ap-max-clients",
+			Usage: "hostapd max number of connected clients, 0 means no limit",
+		},
+		&cli.BoolFlag{
+			Name:  "ap-hidden",
+			Usage: "hostapd does not broadcast the AP ssid",
+		},
+		&cli.BoolFlag{
+			Name:  "ap-isolate",
+			Usage: "hostapd prevents AP clients from talking to each other",
+		},
 		&cli.DurationFlag{
 			Name:  "check-interval",
 			Value: time.Second * 30,
-			Usage: "check interval",
+			Usage: "fallback check interval, wpa_supplicant events also trigger a check",
+		},
+		&cli.DurationFlag{
+			Name:  "netlink-debounce",
+			Value: time.Second * 2,
+			Usage: "wait for ethernet carrier and address changes to settle this long before checking",
+		},
+		&cli.DurationFlag{
+			Name:  "connect-timeout",
+			Value: time.Second * 30,
+			Usage: "how long to wait for a new network to connect before rolling back to the previous config",
+		},
+		&cli.DurationFlag{
+			Name:  "wifi-connect-timeout",
+			Value: time.Minute * 2,
+			Usage: "restart wpa_supplicant if it has been neither connected nor AP for this long",
+		},
+		&cli.StringFlag{
+			Name:  "data-dir",
+			Value: "/var/lib/wificonfig",
+			Usage: "directory where state history, connection attempts, DHCP leases and generated configs are kept",
 		},
 	}
 
 	app.Action = func(c *cli.Context) error {
-		ap := ap.New(c)
-		ws := webserver.New(c.String("listen-port"), ap, c.String("wired-static-config-location"))
-		app := NewApp(c, ws, ap)
+		if c.String("wifi-interface") == "" {
+			name, err := network.DetectWifiInterface()
+			if err != nil {
+				return err
+			}
+			logrus.Infof("using wifi interface %s", name)
+			err = c.Set("wifi-interface", name)
+			if err != nil {
+				return err
+			}
+		}
+
+		if c.Bool("ap-random-psk") {
+			psk, err := ap.GeneratePassphrase()
+			if err != nil {
+				return err
+			}
+			err = c.Set("ap-psk", psk)
+			if err != nil {
+				return err
+			}
+		}
+
+		err := resolveAPTemplates(c)
+		if err != nil {
+			return err
+		}
+
+		credentials := ap.NewCredentials(c)
+		err = credentials.Publish()
+		if err != nil {
+			return err
+		}
+
+		country, err := ap.NewCountry(c.String("country"))
+		if err != nil {
+			return err
+		}
+
+		apBackend, apInterface, apChannels, err := newAPBackend(c, country)
+		if err != nil {
+			return err
+		}
+
+		sm := state.New(c.Duration("wifi-connect-timeout"))
+		portal := captive.New(portalURL(c), func() bool {
+			current, _ := sm.State()
+			return !current.Online()
+		})
+
+		if apBackend == nil {
+			apInterface = c.String("wifi-interface")
+		}
+		captiveAPI, err := captiveAPIURL(c)
+		if err != nil {
+			return err
+		}
+		dhcpServer, err := newDHCPServer(c, apInterface, captiveAPI)
+		if err != nil {
+			return err
+		}
+
+		ap := ap.New(c, country)
+		if apBackend != nil {
+			ap.SetConcurrent(true)
+		}
+		jobStore := jobs.NewStore(filepath.Join(c.String("data-dir"), "jobs.json"))
+		err = jobStore.Load()
+		if err != nil {
+			logrus.Warnf("error loading jobs: %s", err)
+		}
+		prober := network.NewProber(c.String("alive-url"))
+		ws := webserver.New(c.String("listen-port"), ap, sm, jobStore, prober, credentials, dhcpServer, portal, c.String("wired-static-config-location"))
+		ws.PortalPort = c.String("portal-port")
+		app := NewApp(c, ws, ap, dhcpServer, sm, prober, country, credentials, jobStore)
+		if apBackend != nil {
+			app.concurrentAP = apBackend
+			app.APInterfaceName = apInterface
+			app.apChannels = apChannels
+		}
 		return app.Start(c.Context)
 	}
 
 	return app
 }
 
+// resolveAPTemplates replaces placeholders like {mac4} or {serial} in --ap-ssid and --ap-psk with the values of this device.
+func resolveAPTemplates(c *cli.Context) error {
+	info := ap.NewDeviceInfo(c.String("wifi-interface"))
+	for _, flag := range []string{"ap-ssid", "ap-psk"} {
+		value, err := info.Resolve(c.String(flag))
+		if err != nil {
+			return fmt.Errorf("%s: %w", flag, err)
+		}
+		if value == c.String(flag) {
+			continue
+		}
+		err = c.Set(flag, value)
+		if err != nil {
+			return err
+		}
+	}
+	if psk := c.String("ap-psk"); psk != "" {
+		if err := ap.ValidatePSK(psk); err != nil {
+			return fmt.Errorf("ap-psk: %w", err)
+		}
+	}
+	logrus.Infof("AP ssid is %s", c.String("ap-ssid"))
+	return nil
+}
+
+// newAPBackend returns the AP running on its own interface, the name of that interface and how many channels the
+// AP and station may use together. It returns nil if the radio does not support AP and station at the same time,
+// then wpa_supplicant runs the AP on the wifi interface.
+func newAPBackend(c *cli.Context, country *ap.Country) (APController, string, int, error) {
+	backend := c.String("ap-backend")
+	if backend != "wpa_supplicant" && backend != "hostapd" {
+		return nil, "", 0, fmt.Errorf("unknown ap-backend %s", backend)
+	}
+
+	if !c.Bool("concurrent-ap") {
+		if backend == "hostapd" {
+			return nil, "", 0, fmt.Errorf("ap-backend hostapd requires concurrent-ap")
+		}
+		return nil, "", 0, nil
+	}
+
+	channels, err := ap.ConcurrentAPChannels()
+	if err != nil && backend == "hostapd" {
+		return nil, "", 0, fmt.Errorf("ap-backend hostapd: error checking for concurrent AP support: %w", err)
+	}
+	if err != nil {
+		logrus.Warnf("error checking for concurrent AP support: %s", err)
+	}
+	if channels == 0 {
+		if backend == "hostapd" {
+			// hostapd and the station cannot share the interface, the AP is only available from wpa_supplicant.
+			return nil, "", 0, fmt.Errorf("ap-backend hostapd requires a radio supporting AP and station at the same time, use ap-backend wpa_supplicant")
+		}
+		return nil, "", 0, nil
+	}
+
+	logrus.Infof("radio supports AP and station at the same time on %d channels, using %s for the AP with %s", channels, c.String("ap-interface"), backend)
+	if backend == "hostapd" {
+		hostapd := ap.NewHostapd(c, country)
+		return hostapd, hostapd.Interface, channels, hostapd.Validate()
+	}
+	supplicantAP := ap.NewSupplicantAP(c, country)
+	return supplicantAP, supplicantAP.Interface, channels, nil
+}
+
+// portalURL is where clients of our AP are sent, on --portal-port if it is set.
+func portalURL(c *cli.Context) string {
+	port := c.String("listen-port")
+	if c.String("portal-port") != "" {
+		port = c.String("portal-port")
+	}
+	if port == "80" {
+		return fmt.Sprintf("http://%s/", c.String("ap-ip"))
+	}
+	return fmt.Sprintf("http://%s:%s/", c.String("ap-ip"), port)
+}
+
+// captiveAPIURL returns --captive-api-url after checking that it is https, RFC 8908 requires it and clients
+// discard other URLs.
+func captiveAPIURL(c *cli.Context) (string, error) {
+	apiURL := c.String("captive-api-url")
+	if apiURL == "" {
+		return "", nil
+	}
+	u, err := url.Parse(apiURL)
+	if err != nil || u.Scheme != "https" || u.Host == "" {
+		return "", fmt.Errorf("captive-api-url must be an https URL, got %q", apiURL)
+	}
+	return apiURL, nil
+}
+
+// leasingDHCPServer is a DHCPServer that can list its leases for the status API.
+type leasingDHCPServer interface {
+	DHCPServer
+	webserver.LeaseLister
+}
+
+// newDHCPServer returns the DHCP and DNS server for the clients of our AP on iface. captiveAPI is advertised
+// to clients as the RFC 8910 captive portal API if it is not empty.
+func newDHCPServer(c *cli.Context, iface, captiveAPI string) (leasingDHCPServer, error) {
+	switch c.String("dhcp-backend") {
+	case "dnsmasq":
+		dnsmasq := ap.NewDnsmasq(c)
+		dnsmasq.Interface = iface
+		dnsmasq.CaptivePortalAPI = captiveAPI
+		return dnsmasq, nil
+	case "builtin":
+		builtin, err := ap.NewBuiltinDHCP(c)
+		if err != nil {
+			return nil, err
+		}
+		builtin.Interface = iface
+		builtin.CaptivePortalAPI = captiveAPI
+		return builtin, nil
+	}
+	return nil, fmt.Errorf("unknown dhcp-backend %s", c.String("dhcp-backend"))
+}
+
 func globalBefore(c *cli.Context) error {
 	logrus.SetFormatter(&logrus.TextFormatter{TimestampFormat: time.RFC3339Nano, FullTimestamp: true})
 	lvl, err := logrus.ParseLevel(c.String("log-level"))
@@ -1,7 +1,6 @@
 package ap
 
 import (
-	"bufio"
 	"context"
 	"errors"
 	"fmt"
@@ -10,365 +9,247 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
-	"syscall"
 	"time"
 
 	"github.com/nergy-se/wificonfig/pkg/commands"
+	"github.com/nergy-se/wificonfig/pkg/wpa"
 	"github.com/sirupsen/logrus"
 	"github.com/urfave/cli/v2"
 )
 
 type Ap struct {
 	/* data */
-	dnsmasq       *exec.Cmd
-	wpasupplicant *exec.Cmd
+	station *supplicant
 
 	wpaSupplicantConfigFile   string
-	ip                        string
-	dhcpStart                 string
-	dhcpEnd                   string
 	EthernetInterfaceName     string
+	WifiInterfaceName         string
+	apIP                      string
 	wiredStaticConfigLocation string
+	connectTimeout            time.Duration
+	// concurrent is set when our AP runs on its own interface, see SupplicantAP and Hostapd.
+	concurrent  bool
+	country     *Country
+	apBand      string
+	apChannel   int
+	autoChannel bool
+	channel     *ChannelChoice
 
 	mutex sync.Mutex
 }
 
-func New(c *cli.Context) *Ap {
-	return &Ap{
+func New(c *cli.Context, country *Country) *Ap {
+	a := &Ap{
 		EthernetInterfaceName:     c.String("ethernet-interface"),
+		WifiInterfaceName:         c.String("wifi-interface"),
+		apIP:                      c.String("ap-ip"),
 		wpaSupplicantConfigFile:   c.String("wpa-supplicant-config"),
-		ip:                        c.String("ap-ip"),
-		dhcpStart:                 c.String("dhcp-start"),
-		dhcpEnd:                   c.String("dhcp-end"),
 		wiredStaticConfigLocation: c.String("wired-static-config-location"),
-	}
+		connectTimeout:            c.Duration("connect-timeout"),
+		country:                   country,
+		apBand:                    c.String("ap-band"),
+		apChannel:                 c.Int("ap-channel"),
+		autoChannel:               c.Bool("ap-auto-channel"),
+	}
+	a.station = &supplicant{
+		iface:      a.WifiInterfaceName,
+		configFile: a.wpaSupplicantConfigFile,
+		ctrlDir:    wpa.DefaultCtrlDir,
+		onDial:     a.applyAPNetworkMode,
+	}
+	return a
 }
 
-func (a *Ap) StopDnsmasq() error {
-	if cmd := a.DnsMasqCmd(); cmd != nil {
-		logrus.Debug("stopping dnsmasq")
-		return cmd.Process.Signal(syscall.SIGTERM)
-	}
-	return nil
+// SetConcurrent tells us that the AP runs on its own interface so the AP network in
+// wpa_supplicant.conf must not be used by the station interface.
+func (a *Ap) SetConcurrent(concurrent bool) {
+	a.concurrent = concurrent
 }
 
-func (a *Ap) StartDnsmasq(ctx context.Context) error {
-	if cmd := a.DnsMasqCmd(); cmd != nil {
-		err := a.StopDnsmasq()
-		return err
-	}
-	args := []string{
-		"--no-hosts", // Don't read the hostnames in /etc/hosts.
-		"--keep-in-foreground",
-		"--log-queries",
-		"--no-resolv",
-		"--address=/#/" + a.ip,
-		fmt.Sprintf("--dhcp-range=%s,%s,1h", a.dhcpStart, a.dhcpEnd),
-		"--dhcp-authoritative",
-		"--log-facility=-", // log to stderr
-	}
-
-	logrus.Debug(append([]string{"starting: dnsmasq"}, args...))
-	cmd := exec.CommandContext(ctx, "dnsmasq", args...)
-	err := cmd.Start()
+// applyAPNetworkMode disables our mode=2 AP network when running concurrent AP and enables it otherwise.
+// The change is only made in memory but will be persisted with the next SAVE_CONFIG.
+func (a *Ap) applyAPNetworkMode(client *wpa.Client) {
+	networks, err := client.ListNetworks()
 	if err != nil {
-		return fmt.Errorf("error starting dnsmasq: %w", err)
+		logrus.Errorf("error listing networks: %s", err)
+		return
 	}
-	a.mutex.Lock()
-	a.dnsmasq = cmd
-	a.mutex.Unlock()
-	go func() {
-		err := cmd.Wait()
+	for _, n := range networks {
+		if !isAPNetwork(client, n.ID) {
+			continue
+		}
+		switch {
+		case a.concurrent && !n.Disabled:
+			err = client.DisableNetwork(n.ID)
+		case !a.concurrent && n.Disabled:
+			err = client.EnableNetwork(n.ID)
+		}
 		if err != nil {
-			logrus.Error(err)
+			logrus.Errorf("error updating AP network %s: %s", n.ID, err)
 		}
-
-		a.mutex.Lock()
-		a.dnsmasq = nil
-		a.mutex.Unlock()
-	}()
-	return err
+	}
 }
 
 func (a *Ap) StopWpaSupplicant() error {
-	if cmd := a.WpaCmd(); cmd != nil {
-		logrus.Debug("stopping wpa_supplicant")
-		return cmd.Process.Signal(os.Interrupt)
-	}
-	return nil
+	return a.station.Stop()
 }
 
 func (a *Ap) WpaCmd() *exec.Cmd {
-	a.mutex.Lock()
-	defer a.mutex.Unlock()
-	return a.wpasupplicant
+	return a.station.Cmd()
 }
-func (a *Ap) DnsMasqCmd() *exec.Cmd {
-	a.mutex.Lock()
-	defer a.mutex.Unlock()
-	return a.dnsmasq
+
+func (a *Ap) WpaRunning() bool {
+	return a.station.Running()
 }
 
 func (a *Ap) StartWpaSupplicant(ctx context.Context) error {
-	if a.WpaCmd() != nil {
-		return nil
-	}
-
-	logrus.Debug("starting wpa_supplicant")
-
-	args := []string{
-		"-Dnl80211",
-		"-iwlan0",
-		"-c" + a.wpaSupplicantConfigFile,
-	}
-
-	logrus.Debug(append([]string{"starting: wpa_supplicant"}, args...))
-	cmd := exec.CommandContext(ctx, "wpa_supplicant", args...)
-	cmdReader, err := cmd.StdoutPipe()
-	if err != nil {
-		return err
-	}
-
-	scanner := bufio.NewScanner(cmdReader)
-	go func() {
-		for scanner.Scan() {
-			logrus.Infof("wpa_supplicant said: %s\n", scanner.Text())
-		}
-	}()
-	err = cmd.Start()
-	if err != nil {
-		return err
-	}
-
-	a.mutex.Lock()
-	a.wpasupplicant = cmd
-	a.mutex.Unlock()
+	return a.station.Start(ctx)
+}
 
-	go func() {
-		err := cmd.Wait()
-		if err != nil {
-			logrus.Error(err)
-		}
+func (a *Ap) wpa() (*wpa.Client, error) {
+	return a.station.wpa()
+}
 
-		a.mutex.Lock()
-		a.wpasupplicant = nil
-		a.mutex.Unlock()
-	}()
+// WatchWpaEvents calls fn for every wpa_supplicant event until ctx is done.
+// It reconnects whenever wpa_supplicant is (re)started.
+func (a *Ap) WatchWpaEvents(ctx context.Context, fn func(*wpa.Event)) {
+	a.station.WatchEvents(ctx, fn)
+}
 
-	return err
+type WpaNetwork struct {
+	Bssid       string   `json:"bssid"`
+	Frequency   string   `json:"frequency"`
+	SignalLevel string   `json:"signalLevel"`
+	Flags       string   `json:"flags"`
+	Ssid        string   `json:"ssid"`
+	Security    Security `json:"security"`
 }
 
-func (a *Ap) EnsureWpaNetworkAdded() (string, error) {
+func (a *Ap) ScanNetworks() ([]*WpaNetwork, error) {
+	wpaNetworks := []*WpaNetwork{}
 
-	type row struct {
-		ID      string
-		Name    string
-		Current bool
+	client, err := a.wpa()
+	if err != nil {
+		return wpaNetworks, err
 	}
-	networks := []row{}
 
-	networkListOut, err := commands.Run("wpa_cli", "-i", "wlan0", "list_networks")
+	err = a.scan(client)
 	if err != nil {
-		return "", err
+		return wpaNetworks, err
 	}
-	tmp := strings.Split(string(networkListOut), "\n")
-	for _, netRecord := range tmp[1:] {
-
-		fields := strings.Fields(netRecord)
-
-		current := false
-		if len(fields) > 3 && strings.Contains(fields[3], "CURRENT") {
-			current = true
-		}
 
-		if len(fields) > 1 {
-			networks = append(networks, row{
-				ID:      fields[0],
-				Name:    fields[1],
-				Current: current,
-			})
-		}
+	results, err := client.ScanResults()
+	if err != nil {
+		return wpaNetworks, err
 	}
 
-	if len(networks) == 1 && networks[0].ID == "0" { // we need to add our first network.
-		net, err := commands.Run("wpa_cli", "-i", "wlan0", "add_network")
-		if err != nil {
-			return "", err
+	for _, r := range results {
+		if strings.Contains(r.Flags, "[P2P]") || r.SSID == "" {
+			continue
 		}
-		logrus.Infof("add_network: %s", net)
-		return net, nil
-	}
-	if len(networks) > 1 {
-		return networks[1].ID, nil
+		wpaNetworks = append(wpaNetworks, &WpaNetwork{
+			Bssid:       r.BSSID,
+			Frequency:   strconv.Itoa(r.Frequency),
+			SignalLevel: strconv.Itoa(r.SignalLevel),
+			Flags:       r.Flags,
+			Ssid:        r.SSID,
+			Security:    SecurityFromFlags(r.Flags),
+		})
 	}
 
-	return "", nil
+	return wpaNetworks, nil
 }
 
-func (a *Ap) ConnectToNetwork(ssid, key string) error {
+// scanTimeout is how long we wait for a scan, scanning all 2.4 and 5 GHz channels takes a few seconds.
+var scanTimeout = 10 * time.Second
 
-	net, err := a.EnsureWpaNetworkAdded()
+// scan starts a scan and waits until wpa_supplicant reports the results. If the scan fails or takes too long
+// the results of the last scan are used.
+func (a *Ap) scan(client *wpa.Client) error {
+	events, err := wpa.Dial(a.station.ctrlDir, a.WifiInterfaceName)
 	if err != nil {
 		return err
 	}
+	defer events.Close()
 
-	response, err := commands.Run("wpa_cli", "-i", "wlan0", "set_network", net, "ssid", "\""+ssid+"\"")
+	err = events.Attach()
 	if err != nil {
 		return err
 	}
-	logrus.Infof("set_network ssid: %s", response)
 
-	response, err = commands.Run("wpa_cli", "-i", "wlan0", "set_network", net, "psk", "\""+key+"\"")
-	if err != nil {
-		return err
-	}
-	logrus.Infof("set_network psk: %s", response)
-
-	response, err = commands.Run("wpa_cli", "-i", "wlan0", "set_network", net, "key_mgmt", "WPA-PSK")
-	if err != nil {
-		return err
-	}
-	logrus.Infof("set_network key_mgmt: %s", response)
+	ctx, cancel := context.WithTimeout(context.Background(), scanTimeout)
+	defer cancel()
 
-	response, err = commands.Run("wpa_cli", "-i", "wlan0", "set_network", net, "priority", "10")
-	if err != nil {
-		return err
-	}
-	logrus.Infof("set_network priority: %s", response)
+	result := make(chan error, 1)
+	go func() {
+		err := events.Listen(ctx, func(ev *wpa.Event) {
+			var err error
+			switch ev.Name {
+			case wpa.EventScanResults:
+			case wpa.EventScanFailed:
+				err = fmt.Errorf("scan failed: %s", ev.Text)
+			default:
+				return
+			}
+			select {
+			case result <- err:
+			default:
+			}
+			cancel()
+		})
+		select {
+		case result <- err:
+		default:
+		}
+	}()
 
-	response, err = commands.Run("wpa_cli", "-i", "wlan0", "enable_network", net)
-	if err != nil {
+	err = client.Scan()
+	if err != nil && !errors.Is(err, wpa.ErrBusy) { // a running scan reports its results the same way
 		return err
 	}
-	logrus.Infof("enable_network: %s", response)
 
-	response, err = commands.Run("wpa_cli", "-i", "wlan0", "save_config", net)
-	if err != nil {
-		return err
+	err = <-result
+	if errors.Is(err, context.DeadlineExceeded) {
+		err = fmt.Errorf("no scan results after %s", scanTimeout)
 	}
-	logrus.Infof("save_config: %s", response)
-
-	response, err = commands.Run("wpa_cli", "-i", "wlan0", "reconfigure", net)
 	if err != nil {
-		return err
+		logrus.Warnf("using last scan results: %s", err)
 	}
-	logrus.Infof("reconfigure: %s", response)
-
 	return nil
 }
 
-type WpaNetwork struct {
-	Bssid       string `json:"bssid"`
-	Frequency   string `json:"frequency"`
-	SignalLevel string `json:"signalLevel"`
-	Flags       string `json:"flags"`
-	Ssid        string `json:"ssid"`
-}
-
-func (a *Ap) ScanNetworks() ([]*WpaNetwork, error) {
-
-	wpaNetworks := []*WpaNetwork{}
-
-	scanOut, err := commands.Run("wpa_cli", "-i", "wlan0", "scan")
-	if err != nil {
-		return wpaNetworks, err
-	}
-
-	if scanOut != "OK" {
-		return wpaNetworks, fmt.Errorf("expected OK from wpa_cli scan got: %s", scanOut)
-	}
-	time.Sleep(1 * time.Second)
-	networkListOut, err := commands.Run("wpa_cli", "-i", "wlan0", "scan_results")
-	if err != nil {
-		return wpaNetworks, err
-	}
-
-	tmp := strings.Split(string(networkListOut), "\n")
-	for _, netRecord := range tmp[1:] {
-		if strings.Contains(netRecord, "[P2P]") {
-			continue
-		}
-
-		fields := strings.Fields(netRecord)
-
-		if len(fields) > 4 {
-			ssid := strings.Join(fields[4:], " ")
-			wpaNetworks = append(wpaNetworks, &WpaNetwork{
-				Bssid:       fields[0],
-				Frequency:   fields[1],
-				SignalLevel: fields[2],
-				Flags:       fields[3],
-				Ssid:        ssid,
-			})
-		}
-	}
-
-	return wpaNetworks, nil
+func (a *Ap) wpaStatus() (*wpa.Status, error) {
+	return a.station.status()
 }
 
 func (a *Ap) WpaIsAp() (bool, error) {
-	response, err := commands.Run("wpa_cli", "-i", "wlan0", "status")
+	status, err := a.wpaStatus()
 	if err != nil {
 		return false, err
 	}
-	expectedStrings := []string{
-		"ssid=",
-		"mode=AP",
-		"wpa_state=COMPLETED",
-		// "ip_address=",
-	}
-	for _, str := range expectedStrings {
-		if !strings.Contains(response, str) {
-			return false, nil
-		}
-	}
-	return true, nil
+	return status.SSID != "" && status.Mode == "AP" && status.WpaState == "COMPLETED", nil
 }
+
 func (a *Ap) WpaConnectedToWifi() (bool, error) {
-	response, err := commands.Run("wpa_cli", "-i", "wlan0", "status")
+	status, err := a.wpaStatus()
 	if err != nil {
 		return false, err
 	}
-	expectedStrings := []string{
-		"ssid=",
-		"wpa_state=COMPLETED",
-		"mode=station",
-		// "ip_address=",
-	}
-	for _, str := range expectedStrings {
-		if !strings.Contains(response, str) {
-			return false, nil
-		}
-	}
-	return true, nil
+	return status.SSID != "" && status.Mode == "station" && status.WpaState == "COMPLETED", nil
 }
 
 func (a *Ap) GetConnectedSSID() (string, error) {
-	response, err := commands.Run("wpa_cli", "-i", "wlan0", "status")
+	status, err := a.wpaStatus()
 	if err != nil {
 		return "", err
 	}
-	expectedStrings := []string{
-		"ssid=",
-		"wpa_state=COMPLETED",
-		"mode=station",
-		// "ip_address=",
-	}
-	rows := strings.Split(response, "\n")
-	for _, str := range expectedStrings {
-		if !strings.Contains(response, str) {
-			return "", nil
-		}
-	}
-	for _, str := range rows {
-		if strings.HasPrefix(str, "ssid=") {
-			tmp := strings.Split(str, "=")
-			return tmp[1], nil
-		}
+	if status.Mode != "station" || status.WpaState != "COMPLETED" {
+		return "", nil
 	}
-	return "", nil
+	return status.SSID, nil
 }
 
 func (a *Ap) EnsureEthernetStaticIP(ipWithMask, gateway, dns1, dns2 string) error {
@@ -1,5 +1,23 @@
 package ap
 
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nergy-se/wificonfig/pkg/jobs"
+	"github.com/nergy-se/wificonfig/pkg/wpa"
+	"github.com/nergy-se/wificonfig/pkg/wpa/wpatest"
+)
+
 var scanResultString = `bssid / frequency / signal level / flags / ssid
 18:e8:29:c2:8f:84	5180	-63	[WPA2-PSK-CCMP][ESS]	Hokage5
 1e:e8:29:c2:8f:84	5180	-63	[WPA2-PSK-CCMP][ESS]	chromecast
@@ -16,3 +34,894 @@ var scanResultString = `bssid / frequency / signal level / flags / ssid
 1e:e8:29:c1:8f:84	2412	-68	[WPA2-PSK-CCMP][ESS]	hguest
 18:e8:29:c1:8f:84	2412	-71	[WPA2-PSK-CCMP][ESS]	Hokage24
 `
+
+func TestSecurityFromFlags(t *testing.T) {
+	tests := []struct {
+		flags    string
+		expected Security
+	}{
+		{"[WPA2-PSK-CCMP][ESS]", SecurityWPA2},
+		{"[WPA-PSK-TKIP][WPA2-PSK-CCMP][ESS]", SecurityWPA2},
+		{"[WPA2-SAE-CCMP][ESS]", SecurityWPA3},
+		{"[WPA2-PSK+SAE-CCMP][ESS]", SecurityTransition},
+		{"[ESS]", SecurityOpen},
+		{"[WPA2-EAP-CCMP][ESS]", SecurityEnterprise},
+		{"[WEP][ESS]", ""},
+	}
+	for _, tt := range tests {
+		if got := SecurityFromFlags(tt.flags); got != tt.expected {
+			t.Errorf("SecurityFromFlags(%s) = %s expected %s", tt.flags, got, tt.expected)
+		}
+	}
+
+	for _, line := range strings.Split(strings.TrimSpace(scanResultString), "\n")[1:] {
+		fields := strings.Split(line, "\t")
+		if got := SecurityFromFlags(fields[3]); got != SecurityWPA2 {
+			t.Errorf("expected %s to be %s got %s", fields[4], SecurityWPA2, got)
+		}
+	}
+}
+
+func TestConnectResult(t *testing.T) {
+	tests := []struct {
+		events   []string
+		expected error
+	}{
+		{[]string{"<3>CTRL-EVENT-CONNECTED - Connection to 44:d9:e7:f3:91:77 completed [id=1 id_str=]"}, errConnected},
+		{[]string{"<3>CTRL-EVENT-CONNECTED - Connection to 44:d9:e7:f3:91:77 completed [id=0 id_str=]"}, nil},
+		{[]string{`<3>CTRL-EVENT-SSID-TEMP-DISABLED id=1 ssid="house" auth_failures=1 duration=10 reason=WRONG_KEY`}, ErrWrongPassword},
+		{[]string{`<3>CTRL-EVENT-SSID-TEMP-DISABLED id=1 ssid="house" auth_failures=1 duration=10 reason=AUTH_FAILED`}, ErrAuthFailed},
+		{[]string{"<3>CTRL-EVENT-ASSOC-REJECT bssid=44:d9:e7:f3:91:77 status_code=17"}, ErrAssocRejected},
+		{[]string{"<3>CTRL-EVENT-NETWORK-NOT-FOUND"}, nil},
+		{[]string{"<3>CTRL-EVENT-NETWORK-NOT-FOUND", "<3>CTRL-EVENT-NETWORK-NOT-FOUND"}, ErrSSIDNotFound},
+	}
+	for _, tt := range tests {
+		notFound := 0
+		var err error
+		for _, msg := range tt.events {
+			end := strings.IndexByte(msg, '>')
+			name, _, _ := strings.Cut(msg[end+1:], " ")
+			err = connectResult(&wpa.Event{Name: name, Text: msg[end+1:]}, "1", &notFound)
+		}
+		if !errors.Is(err, tt.expected) || (tt.expected == nil && err != nil) {
+			t.Errorf("%v: expected %v got %v", tt.events, tt.expected, err)
+		}
+	}
+}
+
+func TestParseInterfaceCombinations(t *testing.T) {
+	tests := []struct {
+		name     string
+		out      string
+		expected int
+	}{
+		{
+			name: "raspberry pi brcmfmac",
+			out: `Wiphy phy0
+	max # scan SSIDs: 10
+	valid interface combinations:
+		 * #{ managed } <= 1, #{ P2P-device } <= 1, #{ P2P-client, P2P-GO } <= 1,
+		   total <= 3, #channels <= 2
+		 * #{ managed } <= 1, #{ AP } <= 1, #{ P2P-client } <= 1, #{ P2P-device } <= 1,
+		   total <= 4, #channels <= 1
+	Device supports scan flush.
+`,
+			expected: 1,
+		},
+		{
+			name: "shared group",
+			out: `	valid interface combinations:
+		 * #{ managed, AP } <= 2,
+		   total <= 2, #channels <= 1
+`,
+			expected: 1,
+		},
+		{
+			name: "two channels",
+			out: `	valid interface combinations:
+		 * #{ managed } <= 1, #{ AP } <= 1,
+		   total <= 2, #channels <= 1
+		 * #{ managed } <= 1, #{ AP, P2P-GO } <= 1,
+		   total <= 2, #channels <= 2
+`,
+			expected: 2,
+		},
+		{
+			name: "no AP with managed",
+			out: `	valid interface combinations:
+		 * #{ managed } <= 1, #{ P2P-client, P2P-GO } <= 1,
+		   total <= 2, #channels <= 1
+		 * #{ AP } <= 1,
+		   total <= 1, #channels <= 1
+`,
+			expected: 0,
+		},
+		{
+			name:     "no combinations",
+			out:      "Wiphy phy0\n\tSupported interface modes:\n\t\t * managed\n\t\t * AP\n",
+			expected: 0,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseInterfaceCombinations(tt.out); got != tt.expected {
+				t.Errorf("expected %d got %d", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestHostapdConfig(t *testing.T) {
+	h := &Hostapd{
+		Interface:  "uap0",
+		ssid:       "nergy-setup",
+		psk:        "secret123",
+		country:    &Country{code: "SE"},
+		Band:       Band5GHz,
+		Channel:    36,
+		MaxClients: 4,
+		Hidden:     true,
+	}
+	err := h.Validate()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `interface=uap0
+driver=nl80211
+ctrl_interface=/var/run/hostapd
+ssid=nergy-setup
+country_code=SE
+ieee80211d=1
+hw_mode=a
+channel=36
+ieee80211n=1
+wmm_enabled=1
+ieee80211ac=1
+auth_algs=1
+wpa=2
+wpa_key_mgmt=WPA-PSK
+rsn_pairwise=CCMP
+wpa_passphrase=secret123
+ignore_broadcast_ssid=1
+max_num_sta=4
+`
+	if got := h.config(); got != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, got)
+	}
+}
+
+func TestHostapdChannelWidth(t *testing.T) {
+	tests := []struct {
+		band     string
+		channel  int
+		width    int
+		expected []string
+	}{
+		{Band24GHz, 6, 20, nil},
+		{Band24GHz, 3, 40, []string{"ht_capab=[HT40+]"}},
+		{Band24GHz, 11, 40, []string{"ht_capab=[HT40-]"}},
+		{Band24GHz, 11, 80, []string{"ht_capab=[HT40-]"}},
+		{Band5GHz, 36, 40, []string{"ht_capab=[HT40+]"}},
+		{Band5GHz, 48, 40, []string{"ht_capab=[HT40-]"}},
+		{Band5GHz, 44, 80, []string{"ht_capab=[HT40+]", "vht_oper_chwidth=1", "vht_oper_centr_freq_seg0_idx=42"}},
+		{Band5GHz, 161, 80, []string{"ht_capab=[HT40-]", "vht_oper_chwidth=1", "vht_oper_centr_freq_seg0_idx=155"}},
+		{Band5GHz, 165, 80, nil},
+	}
+
+	for _, tt := range tests {
+		h := &Hostapd{Band: tt.band, Channel: tt.channel, ChannelWidth: tt.width, country: &Country{code: "SE"}}
+		var got []string
+		for _, line := range strings.Split(h.config(), "\n") {
+			if strings.HasPrefix(line, "ht_capab=") || strings.HasPrefix(line, "vht_oper_") {
+				got = append(got, line)
+			}
+		}
+		if !slices.Equal(got, tt.expected) {
+			t.Errorf("channel %d %d MHz: expected %v got %v", tt.channel, tt.width, tt.expected, got)
+		}
+	}
+}
+
+func TestHostapdValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		h       *Hostapd
+		wantErr bool
+	}{
+		{name: "2.4GHz", h: &Hostapd{Band: Band24GHz, Channel: 6, psk: "secret123"}},
+		{name: "5GHz channel on 2.4GHz", h: &Hostapd{Band: Band24GHz, Channel: 36, psk: "secret123"}, wantErr: true},
+		{name: "hw_mode a on 2.4GHz", h: &Hostapd{Band: Band24GHz, Channel: 1, HwMode: "a", psk: "secret123"}, wantErr: true},
+		{name: "unknown band", h: &Hostapd{Band: "6GHz", Channel: 1, psk: "secret123"}, wantErr: true},
+		{name: "short psk", h: &Hostapd{Band: Band24GHz, Channel: 1, psk: "short"}, wantErr: true},
+		{name: "40MHz", h: &Hostapd{Band: Band24GHz, Channel: 6, ChannelWidth: 40, psk: "secret123"}},
+		{name: "80MHz", h: &Hostapd{Band: Band5GHz, Channel: 149, ChannelWidth: 80, psk: "secret123"}},
+		{name: "80MHz on 2.4GHz", h: &Hostapd{Band: Band24GHz, Channel: 6, ChannelWidth: 80, psk: "secret123"}, wantErr: true},
+		{name: "40MHz on channel 165", h: &Hostapd{Band: Band5GHz, Channel: 165, ChannelWidth: 40, psk: "secret123"}, wantErr: true},
+		{name: "unknown width", h: &Hostapd{Band: Band5GHz, Channel: 36, ChannelWidth: 60, psk: "secret123"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.h.Validate()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("expected error %t got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestSelectChannel(t *testing.T) {
+	networks := []*WpaNetwork{
+		{Frequency: "2412", SignalLevel: "-40"}, // channel 1 strong
+		{Frequency: "2437", SignalLevel: "-85"}, // channel 6 weak
+		{Frequency: "2437", SignalLevel: "-90"}, // channel 6 weak
+		{Frequency: "2457", SignalLevel: "-50"}, // channel 10 overlaps 11
+		{Frequency: "5180", SignalLevel: "-60"}, // channel 36
+	}
+
+	choice := selectChannel(networks, channels24GHz, 1)
+	if choice.Channel != 6 || choice.Frequency != 2437 {
+		t.Errorf("expected channel 6 got %+v", choice)
+	}
+	if choice.Scores[1].Networks != 2 {
+		t.Errorf("expected 2 networks on channel 6 got %+v", choice.Scores[1])
+	}
+
+	choice = selectChannel(networks, []int{36, 40, 44, 48}, 36)
+	if choice.Channel != 40 || choice.Frequency != 5200 {
+		t.Errorf("expected channel 40 got %+v", choice)
+	}
+
+	choice = selectChannel(nil, channels24GHz, 11)
+	if choice.Channel != 11 {
+		t.Errorf("expected preferred channel 11 on tie got %d", choice.Channel)
+	}
+}
+
+func TestParseAllowedChannels(t *testing.T) {
+	out := `Wiphy phy0
+	Band 1:
+		Frequencies:
+			* 2412 MHz [1] (20.0 dBm)
+			* 2467 MHz [12] (disabled)
+	Band 2:
+		Bitrates (non-HT):
+			* 6.0 Mbps
+		Frequencies:
+			* 5180 MHz [36] (23.0 dBm)
+			* 5200.0 MHz [40] (23.0 dBm)
+			* 5240 MHz [48] (23.0 dBm) (no IR)
+			* 5260 MHz [52] (20.0 dBm) (no IR, radar detection)
+			* 5500 MHz [100] (20.0 dBm) (passive scanning, no IBSS, radar detection)
+			* 5720 MHz [144] (disabled)
+			* 5745 MHz [149] (13.0 dBm)`
+
+	got := parseAllowedChannels(out, Band5GHz)
+	if !slices.Equal(got, []int{36, 40, 149}) {
+		t.Errorf("expected 5GHz channels [36 40 149] got %v", got)
+	}
+	got = parseAllowedChannels(out, Band24GHz)
+	if !slices.Equal(got, []int{1}) {
+		t.Errorf("expected 2.4GHz channels [1] got %v", got)
+	}
+}
+
+func TestFrequencyChannel(t *testing.T) {
+	for _, channel := range []int{1, 6, 11, 13, 14, 36, 48, 149} {
+		if got := FrequencyChannel(ChannelFrequency(channel)); got != channel {
+			t.Errorf("expected channel %d got %d", channel, got)
+		}
+	}
+}
+
+func TestCountryCodes(t *testing.T) {
+	if len(countryCodes) != 249 {
+		t.Errorf("expected 249 country codes got %d", len(countryCodes))
+	}
+	for _, code := range []string{"SE", "US", "DE", "GB"} {
+		if !ValidCountry(code) {
+			t.Errorf("expected %s to be valid", code)
+		}
+	}
+	for _, code := range []string{"", "se", "XX", "SWE", "00"} {
+		if ValidCountry(code) {
+			t.Errorf("expected %s to be invalid", code)
+		}
+	}
+
+	_, err := NewCountry("XX")
+	if !errors.Is(err, ErrInvalidCountry) {
+		t.Errorf("expected ErrInvalidCountry got %v", err)
+	}
+	c, err := NewCountry(" de ")
+	if err != nil || c.Code() != "DE" {
+		t.Errorf("expected DE got %v %v", c.Code(), err)
+	}
+}
+
+func TestSetConfigCountry(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "wpa_supplicant.conf")
+	content := `ctrl_interface=/var/run/wpa_supplicant
+update_config=1
+country=SE
+
+network={
+	ssid="country=SE"
+	psk="secret123"
+}
+`
+	err := os.WriteFile(fn, []byte(content), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = SetConfigCountry(fn, "NO")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := strings.Replace(content, "country=SE\n", "country=NO\n", 1)
+	if string(data) != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, data)
+	}
+
+	err = os.WriteFile(fn, []byte("update_config=1\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = SetConfigCountry(fn, "DK")
+	if err != nil {
+		t.Fatal(err)
+	}
+	country, err := ConfigCountry(fn)
+	if err != nil || country != "DK" {
+		t.Errorf("expected DK got %s %v", country, err)
+	}
+}
+
+func TestDeviceInfoResolve(t *testing.T) {
+	dir := t.TempDir()
+	d := &DeviceInfo{
+		WifiInterfaceName: "wlan0",
+		MachineIDFile:     filepath.Join(dir, "machine-id"),
+		CPUInfoFile:       filepath.Join(dir, "cpuinfo"),
+		hardwareAddr: func(iface string) (net.HardwareAddr, error) {
+			return net.ParseMAC("dc:a6:32:12:ab:cd")
+		},
+		hostname: func() (string, error) {
+			return "nergy-1", nil
+		},
+	}
+	err := os.WriteFile(d.MachineIDFile, []byte("0123456789abcdef0123456789abcdef\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(d.CPUInfoFile, []byte("processor\t: 0\nHardware\t: BCM2835\nRevision\t: c03111\nSerial\t\t: 10000000a1b2c3d4\nModel\t\t: Raspberry Pi 4\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		tmpl     string
+		expected string
+		wantErr  bool
+	}{
+		{tmpl: "nergy-setup", expected: "nergy-setup"},
+		{tmpl: "Nergy-{mac4}", expected: "Nergy-abcd"},
+		{tmpl: "{mac}", expected: "dca63212abcd"},
+		{tmpl: "{hostname}-{machine-id6}", expected: "nergy-1-abcdef"},
+		{tmpl: "{serial}", expected: "10000000a1b2c3d4"},
+		{tmpl: "{serial8}", expected: "a1b2c3d4"},
+		{tmpl: "{serial99}", expected: "10000000a1b2c3d4"},
+		{tmpl: "{unknown}", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.tmpl, func(t *testing.T) {
+			got, err := d.Resolve(tt.tmpl)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("expected error %t got %v", tt.wantErr, err)
+			}
+			if !tt.wantErr && got != tt.expected {
+				t.Errorf("expected %s got %s", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestWifiQRPayload(t *testing.T) {
+	tests := []struct {
+		ssid     string
+		psk      string
+		expected string
+	}{
+		{ssid: "Nergy-abcd", psk: "K7mPq2xR9tWz", expected: "WIFI:T:WPA;S:Nergy-abcd;P:K7mPq2xR9tWz;;"},
+		{ssid: `my;net,"1"`, psk: `a:b\c`, expected: `WIFI:T:WPA;S:my\;net\,\"1\";P:a\:b\\c;;`},
+	}
+	for _, tt := range tests {
+		if got := WifiQRPayload(tt.ssid, tt.psk); got != tt.expected {
+			t.Errorf("expected %s got %s", tt.expected, got)
+		}
+	}
+}
+
+func TestGeneratePassphrase(t *testing.T) {
+	a, err := GeneratePassphrase()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := GeneratePassphrase()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a == b {
+		t.Errorf("expected different passphrases got %s twice", a)
+	}
+	if err := ValidatePSK(a); err != nil {
+		t.Error(err)
+	}
+	if strings.ContainsAny(a, "0O1lI") {
+		t.Errorf("passphrase %s contains ambiguous characters", a)
+	}
+}
+
+func TestCredentialsServe(t *testing.T) {
+	c := &Credentials{Socket: filepath.Join(t.TempDir(), "ap.sock"), ssid: "setup", psk: "first-psk"}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error, 1)
+	go func() { done <- c.Serve(ctx) }()
+
+	read := func() string {
+		var conn net.Conn
+		var err error
+		for i := 0; i < 100; i++ {
+			conn, err = net.Dial("unix", c.Socket)
+			if err == nil {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		data, err := io.ReadAll(conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(data)
+	}
+
+	expected := "ssid=setup\npsk=first-psk\nqr=WIFI:T:WPA;S:setup;P:first-psk;;\n"
+	if got := read(); got != expected {
+		t.Errorf("expected %q got %q", expected, got)
+	}
+	err := c.SetPSK("second-psk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := read(); !strings.Contains(got, "psk=second-psk\n") {
+		t.Errorf("expected rotated passphrase got %q", got)
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDnsmasqConfig(t *testing.T) {
+	d := &Dnsmasq{
+		Interface: "uap0",
+		ip:        "192.168.27.1",
+		dhcpStart: "192.168.27.100",
+		dhcpEnd:   "192.168.27.150",
+		LeaseFile: "/var/lib/wificonfig/dnsmasq.leases",
+
+		CaptivePortalAPI: "https://setup.example.com/api/captive-v1",
+	}
+	expected := `no-hosts
+no-resolv
+log-queries
+log-facility=-
+interface=uap0
+address=/#/192.168.27.1
+dhcp-range=192.168.27.100,192.168.27.150,1h
+dhcp-authoritative
+dhcp-leasefile=/var/lib/wificonfig/dnsmasq.leases
+dhcp-option=114,"https://setup.example.com/api/captive-v1"
+`
+	if got := d.config(); got != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, got)
+	}
+}
+
+func TestParseLeases(t *testing.T) {
+	content := `1760680800 dc:a6:32:12:ab:cd 192.168.27.101 pixel-7 01:dc:a6:32:12:ab:cd
+1760677200 aa:bb:cc:dd:ee:ff 192.168.27.102 * *
+0 11:22:33:44:55:66 192.168.27.103 laptop *
+duid 00:01:00:01:2c:5f:1a:3b:dc:a6:32:12:ab:cd
+1760680800 1234 fd00::10 * 00:01:00:01
+`
+	leases, err := ParseLeases(strings.NewReader(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(leases) != 3 {
+		t.Fatalf("expected 3 leases got %d", len(leases))
+	}
+	if l := leases[0]; l.MAC != "dc:a6:32:12:ab:cd" || l.IP != "192.168.27.101" || l.Hostname != "pixel-7" || !l.Expiry.Equal(time.Unix(1760680800, 0)) {
+		t.Errorf("unexpected lease %+v", l)
+	}
+	if leases[1].Hostname != "" {
+		t.Errorf("expected unknown hostname to be empty got %s", leases[1].Hostname)
+	}
+	if !leases[2].Expiry.IsZero() {
+		t.Errorf("expected infinite lease to have zero expiry got %s", leases[2].Expiry)
+	}
+
+	active := activeLeases(leases, time.Unix(1760680000, 0))
+	if len(active) != 2 || active[0].IP != "192.168.27.101" || active[1].IP != "192.168.27.103" {
+		t.Errorf("expected expired lease to be removed got %+v", active)
+	}
+
+	_, err = ParseLeases(strings.NewReader("1760680800 dc:a6:32:12:ab:cd\n"))
+	if err == nil {
+		t.Error("expected error for truncated lease")
+	}
+}
+
+// newFakeAp returns an Ap talking to a fake wpa_supplicant answering with handler.
+func newFakeAp(t *testing.T, handler wpatest.Handler) (*Ap, *wpatest.Server) {
+	s := wpatest.NewServer(t, "wlan0", handler)
+	a := &Ap{
+		WifiInterfaceName:       "wlan0",
+		wpaSupplicantConfigFile: filepath.Join(t.TempDir(), "wpa_supplicant.conf"),
+		connectTimeout:          time.Second,
+		station:                 &supplicant{iface: "wlan0", ctrlDir: s.Dir},
+	}
+	t.Cleanup(a.station.close)
+	return a, s
+}
+
+var fakeAPNetwork = map[string]string{"ssid": `"nergy-setup"`, "psk": `"password"`, "key_mgmt": "WPA-PSK", "mode": "2"}
+
+func TestAddNetworkPriority(t *testing.T) {
+	networks := wpatest.NewNetworks()
+	apID := networks.Add(fakeAPNetwork)
+	a, _ := newFakeAp(t, networks.Handle)
+
+	first, err := a.AddNetwork(NetworkConfig{SSID: "house", PSK: "password1", Security: SecurityWPA2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := a.AddNetwork(NetworkConfig{SSID: "iot", PSK: "password2", Security: SecurityWPA2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	saved, err := a.SavedNetworks()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(saved) != 2 {
+		t.Fatalf("expected 2 saved networks got %d", len(saved))
+	}
+	if saved[0].ID != second || saved[0].Priority != basePriority+1 {
+		t.Errorf("expected %s with priority %d first got %+v", second, basePriority+1, saved[0])
+	}
+	if saved[1].ID != first || saved[1].Priority != basePriority {
+		t.Errorf("expected %s with priority %d second got %+v", first, basePriority, saved[1])
+	}
+	for _, s := range saved {
+		if s.ID == apID {
+			t.Errorf("AP network listed: %+v", s)
+		}
+	}
+	if _, ok := networks.Get(apID, "priority"); ok {
+		t.Error("expected AP network priority to be left alone")
+	}
+}
+
+func TestReorderNetworks(t *testing.T) {
+	networks := wpatest.NewNetworks()
+	apID := networks.Add(fakeAPNetwork)
+	house := networks.Add(map[string]string{"ssid": `"house"`, "priority": "11"})
+	iot := networks.Add(map[string]string{"ssid": `"iot"`, "priority": "10"})
+	a, _ := newFakeAp(t, networks.Handle)
+
+	invalid := map[string][]string{
+		"incomplete":    {house},
+		"unknown":       {house, "42"},
+		"AP network":    {house, apID},
+		"too many":      {house, iot, apID},
+		"duplicate ids": {house, house},
+	}
+	for name, ids := range invalid {
+		err := a.ReorderNetworks(ids)
+		if err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+	if _, ok := networks.Get(apID, "priority"); ok {
+		t.Error("expected AP network priority to be left alone")
+	}
+
+	err := a.ReorderNetworks([]string{iot, house})
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved, err := a.SavedNetworks()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(saved) != 2 || saved[0].ID != iot || saved[1].ID != house || saved[0].Priority <= saved[1].Priority {
+		t.Errorf("unexpected order: %+v %+v", saved[0], saved[1])
+	}
+}
+
+func TestRemoveNetwork(t *testing.T) {
+	networks := wpatest.NewNetworks()
+	apID := networks.Add(fakeAPNetwork)
+	house := networks.Add(map[string]string{"ssid": `"house"`, "priority": "10"})
+	a, _ := newFakeAp(t, networks.Handle)
+
+	err := a.RemoveNetwork(apID)
+	if !errors.Is(err, ErrNetworkNotFound) {
+		t.Errorf("expected ErrNetworkNotFound removing the AP network got %v", err)
+	}
+	err = a.RemoveNetwork("42")
+	if !errors.Is(err, ErrNetworkNotFound) {
+		t.Errorf("expected ErrNetworkNotFound got %v", err)
+	}
+
+	err = a.RemoveNetwork(house)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := networks.IDs()
+	if len(ids) != 1 || ids[0] != apID {
+		t.Errorf("expected only the AP network left got %v", ids)
+	}
+}
+
+func TestConnectChangesSavedPassword(t *testing.T) {
+	networks := wpatest.NewNetworks()
+	networks.Add(fakeAPNetwork)
+	house := networks.Add(map[string]string{"ssid": `"house"`, "key_mgmt": "WPA-PSK", "psk": `"oldpassword"`, "priority": "10"})
+	selected := make(chan string, 1)
+	a, s := newFakeAp(t, func(cmd string) []string {
+		if id, ok := strings.CutPrefix(cmd, "SELECT_NETWORK "); ok {
+			selected <- id
+		}
+		return networks.Handle(cmd)
+	})
+	go func() {
+		id := <-selected
+		s.Event("<3>CTRL-EVENT-CONNECTED - Connection to 44:d9:e7:f3:91:77 completed [id=" + id + " id_str=]")
+	}()
+
+	err := a.ConnectToNetwork(context.Background(), NetworkConfig{SSID: "house", PSK: "newpassword"}, func(jobs.Phase) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if psk, _ := networks.Get(house, "psk"); psk != `"newpassword"` {
+		t.Errorf("expected new password to be saved got %s", psk)
+	}
+	if keyMgmt, _ := networks.Get(house, "key_mgmt"); keyMgmt != "WPA-PSK" {
+		t.Errorf("expected key_mgmt WPA-PSK got %s", keyMgmt)
+	}
+	if len(networks.IDs()) != 2 {
+		t.Errorf("expected no new network got %v", networks.IDs())
+	}
+}
+
+func TestUpdateNetworkSecurityChange(t *testing.T) {
+	networks := wpatest.NewNetworks()
+	house := networks.Add(map[string]string{"ssid": `"house"`, "key_mgmt": "SAE", "sae_password": `"password"`, "psk": `"password"`, "ieee80211w": "2", "priority": "10"})
+	a, _ := newFakeAp(t, networks.Handle)
+
+	err := a.UpdateNetwork(house, NetworkConfig{Security: SecurityEnterprise, Enterprise: &EnterpriseConfig{EAP: "PEAP", Identity: "user", Password: "secret"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, variable := range []string{"psk", "sae_password"} {
+		if v, ok := networks.Get(house, variable); ok {
+			t.Errorf("expected %s to be unset got %s", variable, v)
+		}
+	}
+	if eap, _ := networks.Get(house, "eap"); eap != "PEAP" {
+		t.Errorf("expected eap PEAP got %s", eap)
+	}
+
+	err = a.UpdateNetwork(house, NetworkConfig{Security: SecurityOpen})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, variable := range []string{"eap", "identity", "password", "phase2"} {
+		if v, ok := networks.Get(house, variable); ok {
+			t.Errorf("expected %s to be unset got %s", variable, v)
+		}
+	}
+	if keyMgmt, _ := networks.Get(house, "key_mgmt"); keyMgmt != "NONE" {
+		t.Errorf("expected key_mgmt NONE got %s", keyMgmt)
+	}
+	if pmf, _ := networks.Get(house, "ieee80211w"); pmf != "0" {
+		t.Errorf("expected ieee80211w 0 got %s", pmf)
+	}
+
+	err = a.UpdateNetwork(house, NetworkConfig{Security: SecurityWPA3, PSK: "password"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, ok := networks.Get(house, "psk"); ok {
+		t.Errorf("expected psk to be unset got %s", v)
+	}
+}
+
+func TestHiddenNetwork(t *testing.T) {
+	networks := wpatest.NewNetworks()
+	networks.Add(fakeAPNetwork)
+	visible := networks.Add(map[string]string{"ssid": `"house"`, "priority": "10"})
+	a, _ := newFakeAp(t, networks.Handle)
+
+	hidden := true
+	id, err := a.AddNetwork(NetworkConfig{SSID: "secret", PSK: "password", Security: SecurityWPA2, Hidden: &hidden})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if scanSSID, _ := networks.Get(id, "scan_ssid"); scanSSID != "1" {
+		t.Errorf("expected scan_ssid 1 got %s", scanSSID)
+	}
+
+	saved, err := a.SavedNetworks()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := findNetwork(saved, id); n == nil || !n.Hidden {
+		t.Errorf("expected %s to be listed as hidden got %+v", id, n)
+	}
+	if n := findNetwork(saved, visible); n == nil || n.Hidden {
+		t.Errorf("expected %s to be listed as not hidden got %+v", visible, n)
+	}
+
+	hidden = false
+	err = a.UpdateNetwork(id, NetworkConfig{Hidden: &hidden})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if scanSSID, _ := networks.Get(id, "scan_ssid"); scanSSID != "0" {
+		t.Errorf("expected scan_ssid 0 got %s", scanSSID)
+	}
+}
+
+func TestConnectEnterpriseKeepsCertsOnFailure(t *testing.T) {
+	networks := wpatest.NewNetworks()
+	selected := make(chan string, 2)
+	a, s := newFakeAp(t, func(cmd string) []string {
+		if id, ok := strings.CutPrefix(cmd, "SELECT_NETWORK "); ok {
+			selected <- id
+		}
+		return networks.Handle(cmd)
+	})
+	results := make(chan string, 2)
+	go func() {
+		for id := range selected {
+			s.Event(fmt.Sprintf(<-results, id))
+		}
+	}()
+	failed := `<3>CTRL-EVENT-SSID-TEMP-DISABLED id=%s ssid="corp" auth_failures=1 duration=10 reason=AUTH_FAILED`
+	connected := "<3>CTRL-EVENT-CONNECTED - Connection to 44:d9:e7:f3:91:77 completed [id=%s id_str=]"
+
+	cert := func(body string) string {
+		return "-----BEGIN CERTIFICATE-----\n" + body + "\n-----END CERTIFICATE-----\n"
+	}
+	oldCA, err := a.writeCert("corp", "ca", cert("b2xk"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	corp := networks.Add(map[string]string{"ssid": `"corp"`, "key_mgmt": "WPA-EAP", "eap": "PEAP", "ca_cert": wpa.Quote(oldCA), "priority": "10"})
+	cfg := NetworkConfig{SSID: "corp", Enterprise: &EnterpriseConfig{EAP: "PEAP", Identity: "user", Password: "secret", CACert: cert("bmV3")}}
+
+	results <- failed
+	err = a.ConnectToNetwork(context.Background(), cfg, func(jobs.Phase) {})
+	if !errors.Is(err, ErrAuthFailed) {
+		t.Fatalf("expected ErrAuthFailed got %v", err)
+	}
+	files, _ := filepath.Glob(filepath.Join(a.certDir(), "*"))
+	if len(files) != 1 || files[0] != oldCA {
+		t.Errorf("expected only %s left got %v", oldCA, files)
+	}
+	if ca, _ := networks.Get(corp, "ca_cert"); ca != wpa.Quote(oldCA) {
+		t.Errorf("expected ca_cert %s got %s", oldCA, ca)
+	}
+
+	results <- connected
+	err = a.ConnectToNetwork(context.Background(), cfg, func(jobs.Phase) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	files, _ = filepath.Glob(filepath.Join(a.certDir(), "*"))
+	ca, _ := networks.Get(corp, "ca_cert")
+	if len(files) != 1 || wpa.Quote(files[0]) != ca || files[0] == oldCA {
+		t.Errorf("expected only the new CA certificate got %v, ca_cert %s", files, ca)
+	}
+}
+
+func TestAddNetworkSpecialCharacters(t *testing.T) {
+	networks := wpatest.NewNetworks()
+	a, _ := newFakeAp(t, networks.Handle)
+
+	id, err := a.AddNetwork(NetworkConfig{SSID: "ssid\"\npriority=100", PSK: `pass"word`, Security: SecurityWPA2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ssid, _ := networks.Get(id, "ssid"); strings.ContainsAny(ssid, "\"\n") {
+		t.Errorf("expected hex encoded ssid got %q", ssid)
+	}
+	if psk, _ := networks.Get(id, "psk"); psk != `"pass"word"` {
+		t.Errorf("expected quoted passphrase got %q", psk)
+	}
+
+	_, err = a.AddNetwork(NetworkConfig{SSID: "house", PSK: "pass\nword", Security: SecurityWPA2})
+	if err == nil {
+		t.Error("expected passphrase with newline to be rejected")
+	}
+}
+
+func TestScanNetworksWaitsForResults(t *testing.T) {
+	networks := wpatest.NewNetworks()
+	networks.ScanResults = scanResultString
+	scanned := make(chan struct{}, 1)
+	a, s := newFakeAp(t, func(cmd string) []string {
+		if cmd == "SCAN" {
+			scanned <- struct{}{}
+			return []string{"OK\n"}
+		}
+		return networks.Handle(cmd)
+	})
+	go func() {
+		<-scanned
+		s.Event("<2>CTRL-EVENT-SCAN-STARTED ")
+		s.Event("<2>CTRL-EVENT-SCAN-RESULTS ")
+	}()
+
+	start := time.Now()
+	found, err := a.ScanNetworks()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if time.Since(start) >= scanTimeout {
+		t.Error("expected scan to return on CTRL-EVENT-SCAN-RESULTS")
+	}
+	if len(found) == 0 {
+		t.Error("expected scan results")
+	}
+}
+
+func TestScanNetworksTimeout(t *testing.T) {
+	defer func(timeout time.Duration) { scanTimeout = timeout }(scanTimeout)
+	scanTimeout = 100 * time.Millisecond
+
+	networks := wpatest.NewNetworks()
+	networks.ScanResults = scanResultString
+	a, _ := newFakeAp(t, func(cmd string) []string {
+		if cmd == "SCAN" {
+			return []string{"FAIL-BUSY\n"}
+		}
+		return networks.Handle(cmd)
+	})
+
+	found, err := a.ScanNetworks()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(found) == 0 {
+		t.Error("expected the last scan results after the timeout")
+	}
+}
@@ -0,0 +1,123 @@
+package ap
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/nergy-se/wificonfig/pkg/dhcp"
+	"github.com/nergy-se/wificonfig/pkg/dns"
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v2"
+)
+
+// BuiltinDHCP serves DHCP and wildcard DNS in process as an alternative to Dnsmasq, so no dnsmasq binary is
+// needed on the device.
+type BuiltinDHCP struct {
+	// Interface is the only interface we answer on.
+	Interface string
+	ip        net.IP
+	leases    *dhcp.Leases
+	// CaptivePortalAPI is sent as DHCP option 114 (RFC 8910) if set.
+	CaptivePortalAPI string
+
+	cancel context.CancelFunc
+	// stopped is closed when both servers have returned.
+	stopped chan struct{}
+	mutex   sync.Mutex
+}
+
+func NewBuiltinDHCP(c *cli.Context) (*BuiltinDHCP, error) {
+	ip := net.ParseIP(c.String("ap-ip")).To4()
+	if ip == nil {
+		return nil, fmt.Errorf("invalid ap-ip %s", c.String("ap-ip"))
+	}
+	leaseTime, err := time.ParseDuration(dhcpLeaseTime)
+	if err != nil {
+		return nil, err
+	}
+	leases, err := dhcp.NewLeases(net.ParseIP(c.String("dhcp-start")), net.ParseIP(c.String("dhcp-end")), leaseTime)
+	if err != nil {
+		return nil, fmt.Errorf("dhcp-start %s and dhcp-end %s: %w", c.String("dhcp-start"), c.String("dhcp-end"), err)
+	}
+	return &BuiltinDHCP{
+		Interface: c.String("wifi-interface"),
+		ip:        ip,
+		leases:    leases,
+	}, nil
+}
+
+// Start serves DHCP and DNS on Interface until Stop is called or ctx is done. If one of them fails both are
+// stopped so the next Start starts both again.
+func (b *BuiltinDHCP) Start(ctx context.Context) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.stopped != nil {
+		select {
+		case <-b.stopped:
+		default:
+			return nil // already running
+		}
+	}
+
+	dhcpServer := dhcp.NewServer(b.Interface, b.ip, b.leases)
+	if b.CaptivePortalAPI != "" {
+		dhcpServer.Options[dhcp.OptionCaptivePortal] = []byte(b.CaptivePortalAPI)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	servers := map[string]func(context.Context) error{
+		"dhcp": dhcpServer.ListenAndServe,
+		"dns":  dns.NewServer(b.Interface, b.ip).ListenAndServe,
+	}
+	logrus.Debugf("starting builtin DHCP and DNS on %s", b.Interface)
+	wg := sync.WaitGroup{}
+	for name, serve := range servers {
+		wg.Add(1)
+		go func(name string, serve func(context.Context) error) {
+			defer wg.Done()
+			err := serve(ctx)
+			if err != nil {
+				logrus.Errorf("builtin %s stopped: %s", name, err)
+			}
+			cancel()
+		}(name, serve)
+	}
+	stopped := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(stopped)
+	}()
+	b.cancel = cancel
+	b.stopped = stopped
+	return nil
+}
+
+// Stop stops serving and waits until the sockets are closed.
+func (b *BuiltinDHCP) Stop() error {
+	b.mutex.Lock()
+	cancel, stopped := b.cancel, b.stopped
+	b.mutex.Unlock()
+	if cancel == nil {
+		return nil
+	}
+	cancel()
+	<-stopped
+	return nil
+}
+
+// Leases returns the addresses handed out to the clients of our AP.
+func (b *BuiltinDHCP) Leases() ([]*Lease, error) {
+	leases := []*Lease{}
+	for _, l := range b.leases.List() {
+		leases = append(leases, &Lease{
+			MAC:      l.MAC.String(),
+			IP:       l.IP.String(),
+			Hostname: l.Hostname,
+			Expiry:   l.Expiry,
+		})
+	}
+	return leases, nil
+}
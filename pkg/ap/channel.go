@@ -0,0 +1,285 @@
+package ap
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nergy-se/wificonfig/pkg/commands"
+	"github.com/nergy-se/wificonfig/pkg/wpa"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	channels24GHz = []int{1, 6, 11}
+	// channels5GHz are used when we cannot ask the radio which channels the regulatory domain allows.
+	channels5GHz = []int{36, 40, 44, 48}
+)
+
+// channels5GHzAllowed returns the 5 GHz channels the radio of wifiInterface may start an AP on in the current
+// regulatory domain, falling back to channels5GHz.
+func channels5GHzAllowed(wifiInterface string) []int {
+	out, err := phyInfo(wifiInterface)
+	if err != nil {
+		logrus.Warnf("error listing channels of %s, using %v: %s", wifiInterface, channels5GHz, err)
+		return channels5GHz
+	}
+	channels := parseAllowedChannels(out, Band5GHz)
+	if len(channels) == 0 {
+		logrus.Warnf("found no usable 5GHz channels on %s, using %v", wifiInterface, channels5GHz)
+		return channels5GHz
+	}
+	return channels
+}
+
+// phyInfo returns `iw phy <phy> info` of the radio of wifiInterface, or `iw list` if we cannot tell which it is.
+// Both list the frequencies with the flags of the regulatory domain set by the country.
+func phyInfo(wifiInterface string) (string, error) {
+	name, err := os.ReadFile(filepath.Join("/sys/class/net", wifiInterface, "phy80211", "name"))
+	if err != nil {
+		return commands.Run("iw", "list")
+	}
+	return commands.Run("iw", "phy", strings.TrimSpace(string(name)), "info")
+}
+
+var frequencyRe = regexp.MustCompile(`^\*\s*(\d+)(?:\.\d+)?\s*MHz\s*\[(\d+)\](.*)$`)
+
+// parseAllowedChannels returns the channels of band in the frequency list of `iw list`. Disabled channels and
+// channels where we may not initiate radiation (no IR, or passive scanning on older iw) are skipped, and so are
+// the radar detection (DFS) ones since the AP would have to wait for a channel availability check:
+//
+//	Frequencies:
+//		* 5180 MHz [36] (23.0 dBm)
+//		* 5260 MHz [52] (20.0 dBm) (no IR, radar detection)
+//		* 5720 MHz [144] (disabled)
+func parseAllowedChannels(out string, band string) []int {
+	var channels []int
+	for _, line := range strings.Split(out, "\n") {
+		m := frequencyRe.FindStringSubmatch(strings.TrimSpace(line))
+		if m == nil {
+			continue
+		}
+		frequency, _ := strconv.Atoi(m[1])
+		channel, _ := strconv.Atoi(m[2])
+		if (band == Band5GHz) != (frequency >= 5000) || FrequencyChannel(frequency) != channel {
+			continue
+		}
+		flags := m[3]
+		if strings.Contains(flags, "disabled") || strings.Contains(flags, "no IR") || strings.Contains(flags, "no-IR") ||
+			strings.Contains(flags, "passive scan") || strings.Contains(flags, "radar detection") {
+			continue
+		}
+		channels = append(channels, channel)
+	}
+	return channels
+}
+
+// ChannelScore is how busy a channel is. Lower is better.
+type ChannelScore struct {
+	Channel  int     `json:"channel"`
+	Networks int     `json:"networks"`
+	Score    float64 `json:"score"`
+}
+
+// ChannelChoice is the channel our AP uses and why.
+type ChannelChoice struct {
+	Channel   int            `json:"channel"`
+	Frequency int            `json:"frequency"`
+	Auto      bool           `json:"auto"`
+	Scores    []ChannelScore `json:"scores,omitempty"`
+	Time      time.Time      `json:"time"`
+}
+
+// ChannelFrequency returns the center frequency in MHz of a 2.4 or 5 GHz channel.
+func ChannelFrequency(channel int) int {
+	switch {
+	case channel == 14:
+		return 2484
+	case channel < 14:
+		return 2407 + channel*5
+	default:
+		return 5000 + channel*5
+	}
+}
+
+// FrequencyChannel returns the channel of a 2.4 or 5 GHz frequency in MHz, or 0 if it is neither.
+func FrequencyChannel(frequency int) int {
+	switch {
+	case frequency == 2484:
+		return 14
+	case frequency >= 2412 && frequency < 2484:
+		return (frequency - 2407) / 5
+	case frequency >= 5000 && frequency < 5900:
+		return (frequency - 5000) / 5
+	}
+	return 0
+}
+
+// selectChannel scores the candidate channels by the networks found on or overlapping them, weighted by
+// signal strength, and picks the least busy. preferred wins ties.
+func selectChannel(networks []*WpaNetwork, candidates []int, preferred int) *ChannelChoice {
+	choice := &ChannelChoice{Auto: true, Time: time.Now()}
+	for _, c := range candidates {
+		score := ChannelScore{Channel: c}
+		for _, n := range networks {
+			frequency, _ := strconv.Atoi(n.Frequency)
+			signal, _ := strconv.Atoi(n.SignalLevel)
+			overlap := channelOverlap(FrequencyChannel(frequency), c)
+			if overlap == 0 {
+				continue
+			}
+			if overlap == 1 {
+				score.Networks++
+			}
+			score.Score += overlap * signalWeight(signal)
+		}
+		choice.Scores = append(choice.Scores, score)
+	}
+
+	best := -1
+	for i, s := range choice.Scores {
+		switch {
+		case best == -1, s.Score < choice.Scores[best].Score:
+			best = i
+		case s.Score == choice.Scores[best].Score && s.Channel == preferred:
+			best = i
+		}
+	}
+	choice.Channel = choice.Scores[best].Channel
+	choice.Frequency = ChannelFrequency(choice.Channel)
+	return choice
+}
+
+// channelOverlap returns how much a network on channel a disturbs channel b, 1 for the same channel and
+// 0 for channels that do not overlap. 2.4 GHz channels are 20 MHz wide with 5 MHz spacing.
+func channelOverlap(a, b int) float64 {
+	if a == 0 {
+		return 0
+	}
+	if a == b {
+		return 1
+	}
+	if a > 14 || b > 14 {
+		return 0
+	}
+	d := a - b
+	if d < 0 {
+		d = -d
+	}
+	if d >= 5 {
+		return 0
+	}
+	return 1 - float64(d)/5
+}
+
+// signalWeight maps a signal level in dBm to a weight between 1 (-100 dBm or weaker) and 71 (-30 dBm or stronger).
+func signalWeight(signal int) float64 {
+	if signal > -30 {
+		signal = -30
+	}
+	if signal < -100 {
+		signal = -100
+	}
+	return float64(signal + 101)
+}
+
+// SelectAPChannel decides the channel of our AP. With auto channel enabled we scan and pick the least busy one,
+// otherwise the configured --ap-channel is used. When the AP runs on the wifi interface the frequency of the AP
+// network is updated in memory so wpa_supplicant uses it the next time it falls back to AP.
+func (a *Ap) SelectAPChannel() (int, error) {
+	choice := &ChannelChoice{Channel: a.apChannel, Frequency: ChannelFrequency(a.apChannel), Time: time.Now()}
+	if a.autoChannel {
+		networks, err := a.ScanNetworks()
+		if err != nil {
+			logrus.Warnf("error scanning for AP channel, using channel %d: %s", a.apChannel, err)
+		} else {
+			candidates := channels24GHz
+			if a.apBand == Band5GHz {
+				candidates = channels5GHzAllowed(a.WifiInterfaceName)
+			}
+			choice = selectChannel(networks, candidates, a.apChannel)
+			logrus.Infof("selected AP channel %d: %+v", choice.Channel, choice.Scores)
+		}
+	}
+
+	a.mutex.Lock()
+	a.channel = choice
+	a.mutex.Unlock()
+
+	if a.concurrent {
+		return choice.Channel, nil
+	}
+	return choice.Channel, a.setAPFrequency(choice.Frequency)
+}
+
+// StationChannel returns the channel of the network the station is connected or connecting to. Before it has
+// picked a BSS it is the channel of the strongest scan result of the enabled saved network with the highest
+// priority, where wpa_supplicant will connect. It is 0 if we cannot tell.
+func (a *Ap) StationChannel() (int, error) {
+	status, err := a.wpaStatus()
+	if err != nil {
+		return 0, err
+	}
+	if status.Mode == "station" && status.Frequency != 0 {
+		return FrequencyChannel(status.Frequency), nil
+	}
+
+	client, err := a.wpa()
+	if err != nil {
+		return 0, err
+	}
+	saved, err := savedNetworks(client)
+	if err != nil {
+		return 0, err
+	}
+	results, err := client.ScanResults()
+	if err != nil {
+		return 0, err
+	}
+	for _, s := range saved {
+		if s.Disabled {
+			continue
+		}
+		var best *wpa.ScanResult
+		for _, r := range results {
+			if r.SSID == s.SSID && (best == nil || r.SignalLevel > best.SignalLevel) {
+				best = r
+			}
+		}
+		if best != nil {
+			return FrequencyChannel(best.Frequency), nil
+		}
+	}
+	return 0, nil
+}
+
+// APChannel returns the last channel choice or nil if we have not selected one yet.
+func (a *Ap) APChannel() *ChannelChoice {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return a.channel
+}
+
+func (a *Ap) setAPFrequency(frequency int) error {
+	client, err := a.wpa()
+	if err != nil {
+		return err
+	}
+	networks, err := client.ListNetworks()
+	if err != nil {
+		return err
+	}
+	for _, n := range networks {
+		if !isAPNetwork(client, n.ID) {
+			continue
+		}
+		err = client.SetNetwork(n.ID, "frequency", strconv.Itoa(frequency))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
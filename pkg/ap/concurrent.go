@@ -0,0 +1,110 @@
+package ap
+
+import (
+	"net"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/nergy-se/wificonfig/pkg/commands"
+	"github.com/sirupsen/logrus"
+)
+
+// ConcurrentAPChannels returns how many channels an AP and a managed interface may use at the same time according
+// to the valid interface combinations in `iw list`. It is 0 if the radio cannot run them together and 1 if the
+// AP must use the channel of the station.
+func ConcurrentAPChannels() (int, error) {
+	out, err := commands.Run("iw", "list")
+	if err != nil {
+		return 0, err
+	}
+	return parseInterfaceCombinations(out), nil
+}
+
+var (
+	combinationLimitRe    = regexp.MustCompile(`#\{([^}]*)\}\s*<=\s*(\d+)`)
+	combinationTotalRe    = regexp.MustCompile(`total\s*<=\s*(\d+)`)
+	combinationChannelsRe = regexp.MustCompile(`#channels\s*<=\s*(\d+)`)
+)
+
+// parseInterfaceCombinations looks for combinations allowing managed and AP at the same time in the
+// "valid interface combinations" section of `iw list` and returns the highest #channels of them, 0 if there is none:
+//
+//	valid interface combinations:
+//		 * #{ managed } <= 1, #{ P2P-device } <= 1, #{ P2P-client, P2P-GO } <= 1,
+//		   total <= 3, #channels <= 2
+//		 * #{ managed } <= 1, #{ AP } <= 1, #{ P2P-client } <= 1, #{ P2P-device } <= 1,
+//		   total <= 4, #channels <= 1
+func parseInterfaceCombinations(out string) int {
+	var combinations []string
+	in := false
+	for _, line := range strings.Split(out, "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(line, "valid interface combinations:"):
+			in = true
+		case !in:
+		case strings.HasPrefix(line, "* "):
+			combinations = append(combinations, strings.TrimPrefix(line, "* "))
+		case len(combinations) > 0 && strings.HasPrefix(line, "total"):
+			combinations[len(combinations)-1] += " " + line
+		default:
+			in = false
+		}
+	}
+
+	channels := 0
+	for _, c := range combinations {
+		if !combinationAllowsAP(c) {
+			continue
+		}
+		n := 1 // iw always prints #channels, assume the strictest limit if it is missing.
+		if m := combinationChannelsRe.FindStringSubmatch(c); m != nil {
+			n, _ = strconv.Atoi(m[1])
+		}
+		channels = max(channels, n)
+	}
+	return channels
+}
+
+func combinationAllowsAP(combination string) bool {
+	total := combinationTotalRe.FindStringSubmatch(combination)
+	if total == nil {
+		return false
+	}
+	if n, _ := strconv.Atoi(total[1]); n < 2 {
+		return false
+	}
+
+	managed, ap := 0, 0
+	for _, m := range combinationLimitRe.FindAllStringSubmatch(combination, -1) {
+		n, _ := strconv.Atoi(m[2])
+		types := strings.Split(m[1], ",")
+		for i := range types {
+			types[i] = strings.TrimSpace(types[i])
+		}
+		hasManaged := slices.Contains(types, "managed")
+		hasAP := slices.Contains(types, "AP")
+		switch {
+		case hasManaged && hasAP && n >= 2:
+			return true
+		case hasManaged:
+			managed += n
+		case hasAP:
+			ap += n
+		}
+	}
+	return managed > 0 && ap > 0
+}
+
+// ensureAPInterface creates the virtual AP interface on the wifi interface if it does not exist.
+func ensureAPInterface(wifiInterface, apInterface string) error {
+	if _, err := net.InterfaceByName(apInterface); err == nil {
+		return nil
+	}
+
+	logrus.Infof("creating AP interface %s on %s", apInterface, wifiInterface)
+	_, err := commands.Run("iw", "dev", wifiInterface, "interface", "add", apInterface, "type", "__ap")
+	return err
+}
@@ -0,0 +1,243 @@
+package ap
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/nergy-se/wificonfig/pkg/jobs"
+	"github.com/nergy-se/wificonfig/pkg/wpa"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	ErrWrongPassword     = errors.New("wrong password")
+	ErrSSIDNotFound      = errors.New("network not found")
+	ErrAssocRejected     = errors.New("association rejected")
+	ErrAuthFailed        = errors.New("authentication failed")
+	ErrConnectionTimeout = errors.New("timeout waiting for connection")
+)
+
+// ConnectToNetwork tries cfg with the highest priority and only saves it to wpa_supplicant.conf if
+// we manage to connect within the connect timeout. On failure the saved config is reloaded so the
+// previous networks and our AP are restored.
+// progress is called when the attempt moves to the next phase.
+func (a *Ap) ConnectToNetwork(ctx context.Context, cfg NetworkConfig, progress func(jobs.Phase)) error {
+	ssid := cfg.SSID
+	client, err := a.wpa()
+	if err != nil {
+		return err
+	}
+	defer a.pruneCerts(client, ssid)
+
+	networks, err := client.ListNetworks()
+	if err != nil {
+		return err
+	}
+	saved, err := savedNetworks(client)
+	if err != nil {
+		return err
+	}
+
+	id := ""
+	for _, s := range saved {
+		if s.SSID == ssid {
+			id = s.ID
+			break
+		}
+	}
+
+	cfg.Priority = nextPriority(saved)
+	if id == "" {
+		id, err = a.addNetwork(client, cfg)
+		if err != nil {
+			return err
+		}
+	} else {
+		cfg.SSID = ""
+		updateSecurity(client, ssid, &cfg)
+		err = a.updateNetwork(client, id, cfg)
+		if err != nil {
+			a.rollback(client)
+			return err
+		}
+	}
+
+	err = a.tryNetwork(ctx, client, id, progress)
+	if err != nil {
+		logrus.Errorf("connecting to %s failed: %s", ssid, err)
+		a.rollback(client)
+		return err
+	}
+
+	// SELECT_NETWORK disabled all other networks, enable the ones that were enabled before.
+	for _, n := range networks {
+		if n.ID == id || n.Disabled {
+			continue
+		}
+		err = client.EnableNetwork(n.ID)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = client.SaveConfig()
+	if err != nil {
+		return err
+	}
+	logrus.Infof("connected to network %s with ssid: %s", id, ssid)
+
+	return nil
+}
+
+// rollback discards everything not saved in wpa_supplicant.conf. Certificates written for the attempt are
+// left for pruneCerts, the saved config still refers to the previous ones.
+func (a *Ap) rollback(client *wpa.Client) {
+	err := client.Reconfigure()
+	if err != nil {
+		logrus.Errorf("error reloading wpa_supplicant config: %s", err)
+		return
+	}
+	a.applyAPNetworkMode(client)
+}
+
+// tryNetwork selects network id and waits for it to connect or fail.
+func (a *Ap) tryNetwork(ctx context.Context, client *wpa.Client, id string, progress func(jobs.Phase)) error {
+	events, err := wpa.Dial(a.station.ctrlDir, a.WifiInterfaceName)
+	if err != nil {
+		return err
+	}
+	defer events.Close()
+
+	err = events.Attach()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, a.connectTimeout)
+	defer cancel()
+
+	result := make(chan error, 1)
+	go func() {
+		notFound := 0
+		err := events.Listen(ctx, func(ev *wpa.Event) {
+			if phase := phaseFromEvent(ev); phase != "" {
+				progress(phase)
+			}
+			err := connectResult(ev, id, &notFound)
+			if err == nil {
+				return
+			}
+			select {
+			case result <- err:
+			default:
+			}
+			cancel()
+		})
+		if errors.Is(err, context.DeadlineExceeded) {
+			err = ErrConnectionTimeout
+		}
+		select {
+		case result <- err:
+		default:
+		}
+	}()
+
+	progress(jobs.PhaseAssociating)
+	err = client.SelectNetwork(id)
+	if err != nil {
+		return err
+	}
+
+	err = <-result
+	if errors.Is(err, errConnected) {
+		return nil
+	}
+	return err
+}
+
+var errConnected = errors.New("connected")
+
+func phaseFromEvent(ev *wpa.Event) jobs.Phase {
+	switch {
+	case strings.HasPrefix(ev.Text, "Trying to associate"), strings.HasPrefix(ev.Text, "SME: Trying to authenticate"):
+		return jobs.PhaseAssociating
+	case strings.HasPrefix(ev.Text, "Associated with"):
+		return jobs.PhaseAuthenticating
+	}
+	return ""
+}
+
+// connectResult maps wpa_supplicant events for network id to the outcome of the connection attempt.
+// It returns nil as long as we should keep waiting.
+func connectResult(ev *wpa.Event, id string, notFound *int) error {
+	switch ev.Name {
+	case wpa.EventConnected:
+		if ev.Field("id") == id {
+			return errConnected
+		}
+	case wpa.EventSSIDTempDisabled:
+		if ev.Field("id") != id {
+			return nil
+		}
+		if ev.Field("reason") == "WRONG_KEY" {
+			return ErrWrongPassword
+		}
+		return fmt.Errorf("%w: %s", ErrAuthFailed, strings.ToLower(ev.Field("reason")))
+	case wpa.EventEAPFailure:
+		return ErrAuthFailed
+	case wpa.EventAssocReject:
+		return fmt.Errorf("%w: status code %s", ErrAssocRejected, ev.Field("status_code"))
+	case wpa.EventNetworkNotFound:
+		// the first scan might have been started before we selected the network.
+		*notFound++
+		if *notFound > 1 {
+			return ErrSSIDNotFound
+		}
+	}
+	return nil
+}
+
+// WaitForAddress waits until the wifi interface got an IPv4 address which is not our AP address.
+func (a *Ap) WaitForAddress(ctx context.Context) (net.IP, error) {
+	ctx, cancel := context.WithTimeout(ctx, a.connectTimeout)
+	defer cancel()
+
+	ticker := time.NewTicker(500 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		if ip := a.wifiAddress(); ip != nil {
+			return ip, nil
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			if errors.Is(ctx.Err(), context.Canceled) {
+				return nil, ctx.Err()
+			}
+			return nil, fmt.Errorf("timeout waiting for DHCP address on %s", a.WifiInterfaceName)
+		}
+	}
+}
+
+func (a *Ap) wifiAddress() net.IP {
+	iface, err := net.InterfaceByName(a.WifiInterfaceName)
+	if err != nil {
+		return nil
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil
+	}
+	for _, addr := range addrs {
+		ip, _, err := net.ParseCIDR(addr.String())
+		if err != nil || ip.To4() == nil || ip.Equal(net.ParseIP(a.apIP)) {
+			continue
+		}
+		return ip
+	}
+	return nil
+}
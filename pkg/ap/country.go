@@ -0,0 +1,124 @@
+package ap
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/nergy-se/wificonfig/pkg/wpaconf"
+)
+
+var ErrInvalidCountry = errors.New("invalid country code")
+
+// countryCodes are the officially assigned ISO 3166-1 alpha-2 codes.
+var countryCodes = strings.Fields(`
+AD AE AF AG AI AL AM AO AQ AR AS AT AU AW AX AZ
+BA BB BD BE BF BG BH BI BJ BL BM BN BO BQ BR BS BT BV BW BY BZ
+CA CC CD CF CG CH CI CK CL CM CN CO CR CU CV CW CX CY CZ
+DE DJ DK DM DO DZ
+EC EE EG EH ER ES ET
+FI FJ FK FM FO FR
+GA GB GD GE GF GG GH GI GL GM GN GP GQ GR GS GT GU GW GY
+HK HM HN HR HT HU
+ID IE IL IM IN IO IQ IR IS IT
+JE JM JO JP
+KE KG KH KI KM KN KP KR KW KY KZ
+LA LB LC LI LK LR LS LT LU LV LY
+MA MC MD ME MF MG MH MK ML MM MN MO MP MQ MR MS MT MU MV MW MX MY MZ
+NA NC NE NF NG NI NL NO NP NR NU NZ
+OM
+PA PE PF PG PH PK PL PM PN PR PS PT PW PY
+QA
+RE RO RS RU RW
+SA SB SC SD SE SG SH SI SJ SK SL SM SN SO SR SS ST SV SX SY SZ
+TC TD TF TG TH TJ TK TL TM TN TO TR TT TV TW TZ
+UA UG UM US UY UZ
+VA VC VE VG VI VN VU
+WF WS
+YE YT
+ZA ZM ZW
+`)
+
+// ValidCountry reports if code is an ISO 3166-1 alpha-2 country code.
+func ValidCountry(code string) bool {
+	return slices.Contains(countryCodes, code)
+}
+
+// Country is the regulatory country shared by wpa_supplicant and the AP backends.
+type Country struct {
+	code  string
+	mutex sync.Mutex
+}
+
+func NewCountry(code string) (*Country, error) {
+	c := &Country{}
+	return c, c.Set(code)
+}
+
+func (c *Country) Code() string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.code
+}
+
+func (c *Country) Set(code string) error {
+	code = strings.ToUpper(strings.TrimSpace(code))
+	if !ValidCountry(code) {
+		return fmt.Errorf("%w: %s", ErrInvalidCountry, code)
+	}
+	c.mutex.Lock()
+	c.code = code
+	c.mutex.Unlock()
+	return nil
+}
+
+// ConfigCountry returns the country set in the global section of a wpa_supplicant config or "" if there is none.
+func ConfigCountry(file string) (string, error) {
+	cfg, err := wpaconf.Load(file)
+	if err != nil {
+		return "", err
+	}
+	country, _ := cfg.Global("country")
+	return country, nil
+}
+
+// SetConfigCountry replaces the country in the global section of a wpa_supplicant config, adding it if missing.
+func SetConfigCountry(file, code string) error {
+	cfg, err := wpaconf.Load(file)
+	if err != nil {
+		return err
+	}
+	cfg.SetGlobal("country", code)
+	return cfg.Save(file)
+}
+
+// SetCountry changes the regulatory country in wpa_supplicant.conf and in the running wpa_supplicant.
+// The AP backends use it the next time they start.
+func (a *Ap) SetCountry(code string) error {
+	err := a.country.Set(code)
+	if err != nil {
+		return err
+	}
+	code = a.country.Code()
+
+	err = SetConfigCountry(a.wpaSupplicantConfigFile, code)
+	if err != nil {
+		return err
+	}
+
+	if !a.WpaRunning() {
+		return nil
+	}
+	client, err := a.wpa()
+	if err != nil {
+		return err
+	}
+	return client.Set("country", code)
+}
+
+// Country returns the current regulatory country.
+func (a *Ap) Country() string {
+	return a.country.Code()
+}
@@ -0,0 +1,198 @@
+package ap
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/nergy-se/wificonfig/pkg/wpa"
+	"github.com/nergy-se/wificonfig/pkg/wpaconf"
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v2"
+)
+
+// passphraseAlphabet leaves out characters that are easy to mix up on a small display like 0/O and 1/l/I.
+const passphraseAlphabet = "abcdefghijkmnpqrstuvwxyzABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+
+const passphraseLength = 12
+
+// GeneratePassphrase returns a random WPA passphrase.
+func GeneratePassphrase() (string, error) {
+	max := big.NewInt(int64(len(passphraseAlphabet)))
+	b := make([]byte, passphraseLength)
+	for i := range b {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		b[i] = passphraseAlphabet[n.Int64()]
+	}
+	return string(b), nil
+}
+
+// WifiQRPayload returns the WIFI: payload phones understand when scanning a QR code.
+func WifiQRPayload(ssid, psk string) string {
+	escape := strings.NewReplacer(`\`, `\\`, `;`, `\;`, `,`, `\,`, `:`, `\:`, `"`, `\"`)
+	return fmt.Sprintf("WIFI:T:WPA;S:%s;P:%s;;", escape.Replace(ssid), escape.Replace(psk))
+}
+
+// Credentials is the ssid and passphrase of our AP. They are published to --ap-psk-file and --ap-psk-socket
+// so a local display or LED driver can show them.
+type Credentials struct {
+	File   string
+	Socket string
+
+	ssid  string
+	psk   string
+	mutex sync.Mutex
+}
+
+func NewCredentials(c *cli.Context) *Credentials {
+	return &Credentials{
+		File:   c.String("ap-psk-file"),
+		Socket: c.String("ap-psk-socket"),
+		ssid:   c.String("ap-ssid"),
+		psk:    c.String("ap-psk"),
+	}
+}
+
+func (c *Credentials) SSID() string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.ssid
+}
+
+func (c *Credentials) PSK() string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.psk
+}
+
+// SetPSK changes the passphrase and publishes it.
+func (c *Credentials) SetPSK(psk string) error {
+	c.mutex.Lock()
+	c.psk = psk
+	c.mutex.Unlock()
+	return c.Publish()
+}
+
+// content returns the published credentials, one key=value per line.
+func (c *Credentials) content() []byte {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return []byte(fmt.Sprintf("ssid=%s\npsk=%s\nqr=%s\n", c.ssid, c.psk, WifiQRPayload(c.ssid, c.psk)))
+}
+
+// Publish writes the credentials to File atomically. It does nothing if File is not set.
+func (c *Credentials) Publish() error {
+	if c.File == "" {
+		return nil
+	}
+	tmp := c.File + ".tmp"
+	err := os.WriteFile(tmp, c.content(), 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, c.File)
+}
+
+// Serve answers every connection to the unix socket Socket with the current credentials and closes it.
+// It returns when ctx is done.
+func (c *Credentials) Serve(ctx context.Context) error {
+	err := os.MkdirAll(filepath.Dir(c.Socket), 0755)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(c.Socket)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	l, err := net.Listen("unix", c.Socket)
+	if err != nil {
+		return err
+	}
+	err = os.Chmod(c.Socket, 0600)
+	if err != nil {
+		l.Close()
+		return err
+	}
+	go func() {
+		<-ctx.Done()
+		l.Close()
+	}()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		_, err = conn.Write(c.content())
+		if err != nil {
+			logrus.Debugf("error writing AP credentials to socket: %s", err)
+		}
+		conn.Close()
+	}
+}
+
+// SetAPPSK changes the passphrase of our AP network in wpa_supplicant.conf and in the running wpa_supplicant.
+// wpa_supplicant uses it the next time it falls back to AP, an AP it is running is restarted to use it now.
+func (a *Ap) SetAPPSK(psk string) error {
+	cfg, err := wpaconf.Load(a.wpaSupplicantConfigFile)
+	if err != nil {
+		return err
+	}
+	if network := cfg.APNetwork(); network != nil {
+		network.Set("psk", wpa.QuotePassphrase(psk))
+		err = cfg.Save(a.wpaSupplicantConfigFile)
+		if err != nil {
+			return err
+		}
+	}
+
+	if !a.WpaRunning() {
+		return nil
+	}
+	client, err := a.wpa()
+	if err != nil {
+		return err
+	}
+	isAP, err := a.WpaIsAp()
+	if err != nil {
+		return err
+	}
+	networks, err := client.ListNetworks()
+	if err != nil {
+		return err
+	}
+	for _, n := range networks {
+		if !isAPNetwork(client, n.ID) {
+			continue
+		}
+		err = client.SetNetwork(n.ID, "psk", wpa.QuotePassphrase(psk))
+		if err != nil {
+			return err
+		}
+		if !isAP {
+			continue
+		}
+		err = client.DisableNetwork(n.ID)
+		if err != nil {
+			return err
+		}
+		err = client.EnableNetwork(n.ID)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,140 @@
+package ap
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v2"
+)
+
+// dhcpLeaseTime is how long clients of our AP keep their address.
+const dhcpLeaseTime = "1h"
+
+// Dnsmasq supervises the dnsmasq process serving DHCP and wildcard DNS while in AP mode.
+type Dnsmasq struct {
+	cmd *exec.Cmd
+
+	// Interface is the only interface dnsmasq answers on.
+	Interface  string
+	ip         string
+	dhcpStart  string
+	dhcpEnd    string
+	configFile string
+	LeaseFile  string
+	// CaptivePortalAPI is sent as DHCP option 114 (RFC 8910) if set.
+	CaptivePortalAPI string
+
+	mutex sync.Mutex
+}
+
+func NewDnsmasq(c *cli.Context) *Dnsmasq {
+	return &Dnsmasq{
+		Interface:  c.String("wifi-interface"),
+		ip:         c.String("ap-ip"),
+		dhcpStart:  c.String("dhcp-start"),
+		dhcpEnd:    c.String("dhcp-end"),
+		configFile: filepath.Join(c.String("data-dir"), "dnsmasq.conf"),
+		LeaseFile:  filepath.Join(c.String("data-dir"), "dnsmasq.leases"),
+	}
+}
+
+// config returns the dnsmasq.conf content. Every name resolves to our AP ip so clients end up on the portal.
+func (d *Dnsmasq) config() string {
+	lines := []string{
+		"no-hosts", // Don't read the hostnames in /etc/hosts.
+		"no-resolv",
+		"log-queries",
+		"log-facility=-", // log to stderr
+		"interface=" + d.Interface,
+		"address=/#/" + d.ip,
+		fmt.Sprintf("dhcp-range=%s,%s,%s", d.dhcpStart, d.dhcpEnd, dhcpLeaseTime),
+		"dhcp-authoritative",
+		"dhcp-leasefile=" + d.LeaseFile,
+	}
+	if d.CaptivePortalAPI != "" {
+		lines = append(lines, fmt.Sprintf("dhcp-option=114,%q", d.CaptivePortalAPI))
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+func (d *Dnsmasq) Cmd() *exec.Cmd {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.cmd
+}
+
+func (d *Dnsmasq) Stop() error {
+	if cmd := d.Cmd(); cmd != nil {
+		logrus.Debug("stopping dnsmasq")
+		return cmd.Process.Signal(syscall.SIGTERM)
+	}
+	return nil
+}
+
+func (d *Dnsmasq) Start(ctx context.Context) error {
+	if d.Cmd() != nil {
+		return nil // already running
+	}
+
+	err := os.MkdirAll(filepath.Dir(d.configFile), 0755)
+	if err != nil {
+		return err
+	}
+	err = os.WriteFile(d.configFile, []byte(d.config()), 0644)
+	if err != nil {
+		return err
+	}
+
+	args := []string{
+		"--keep-in-foreground",
+		"--conf-file=" + d.configFile,
+	}
+
+	logrus.Debug(append([]string{"starting: dnsmasq"}, args...))
+	cmd := exec.CommandContext(ctx, "dnsmasq", args...)
+	err = cmd.Start()
+	if err != nil {
+		return fmt.Errorf("error starting dnsmasq: %w", err)
+	}
+	d.mutex.Lock()
+	d.cmd = cmd
+	d.mutex.Unlock()
+	go func() {
+		err := cmd.Wait()
+		if err != nil {
+			logrus.Error(err)
+		}
+
+		d.mutex.Lock()
+		d.cmd = nil
+		d.mutex.Unlock()
+	}()
+	return err
+}
+
+// Leases returns the unexpired leases handed out by dnsmasq. It is empty if dnsmasq has not run yet.
+func (d *Dnsmasq) Leases() ([]*Lease, error) {
+	f, err := os.Open(d.LeaseFile)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return []*Lease{}, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	leases, err := ParseLeases(f)
+	if err != nil {
+		return nil, err
+	}
+	return activeLeases(leases, time.Now()), nil
+}
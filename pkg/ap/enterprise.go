@@ -0,0 +1,181 @@
+package ap
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/nergy-se/wificonfig/pkg/wpa"
+	"github.com/sirupsen/logrus"
+)
+
+const SecurityEnterprise Security = "wpa2-enterprise"
+
+var eapMethods = []string{"PEAP", "TTLS", "TLS"}
+
+// EnterpriseConfig holds 802.1X credentials. Certificates and keys are PEM encoded.
+type EnterpriseConfig struct {
+	EAP                string `json:"eap"` // PEAP, TTLS or TLS
+	Identity           string `json:"identity"`
+	AnonymousIdentity  string `json:"anonymousIdentity"`
+	Password           string `json:"password"`
+	Phase2             string `json:"phase2"` // for example MSCHAPV2 or PAP, defaults to MSCHAPV2
+	CACert             string `json:"caCert"`
+	ClientCert         string `json:"clientCert"`
+	PrivateKey         string `json:"privateKey"`
+	PrivateKeyPassword string `json:"privateKeyPassword"`
+}
+
+func (e *EnterpriseConfig) validate() error {
+	e.EAP = strings.ToUpper(e.EAP)
+	if !slices.Contains(eapMethods, e.EAP) {
+		return fmt.Errorf("eap must be one of %s", strings.Join(eapMethods, ", "))
+	}
+	if e.Identity == "" {
+		return fmt.Errorf("missing identity")
+	}
+	if e.EAP == "TLS" {
+		if e.ClientCert == "" || e.PrivateKey == "" {
+			return fmt.Errorf("EAP-TLS requires client certificate and private key")
+		}
+		return nil
+	}
+	if e.Password == "" {
+		return fmt.Errorf("missing password")
+	}
+	return nil
+}
+
+// certDir is where certificates for enterprise networks are stored, next to the wpa_supplicant config.
+func (a *Ap) certDir() string {
+	return filepath.Join(filepath.Dir(a.wpaSupplicantConfigFile), "wificonfig-certs")
+}
+
+// certPrefix returns the file name prefix for certificates belonging to ssid.
+func (a *Ap) certPrefix(ssid string) string {
+	sum := sha256.Sum256([]byte(ssid))
+	return filepath.Join(a.certDir(), hex.EncodeToString(sum[:8]))
+}
+
+// writeCert stores a certificate or key of ssid in a file named by its content, so the files a saved network
+// refers to are never overwritten while a new config is tried. pruneCerts removes the ones no longer used.
+func (a *Ap) writeCert(ssid, name, content string) (string, error) {
+	block, _ := pem.Decode([]byte(content))
+	if block == nil {
+		return "", fmt.Errorf("%s is not PEM encoded", name)
+	}
+
+	err := os.MkdirAll(a.certDir(), 0700)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256([]byte(content))
+	fn := a.certPrefix(ssid) + "-" + name + "-" + hex.EncodeToString(sum[:8]) + ".pem"
+	return fn, os.WriteFile(fn, []byte(content), 0600)
+}
+
+func (a *Ap) removeCerts(ssid string) error {
+	files, err := filepath.Glob(a.certPrefix(ssid) + "-*.pem")
+	if err != nil {
+		return err
+	}
+	for _, fn := range files {
+		err := os.Remove(fn)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pruneCerts removes the certificate files of ssid that no network refers to, like the ones of a config that
+// failed to connect or was replaced.
+func (a *Ap) pruneCerts(client *wpa.Client, ssid string) {
+	files, err := filepath.Glob(a.certPrefix(ssid) + "-*.pem")
+	if err != nil || len(files) == 0 {
+		return
+	}
+	networks, err := client.ListNetworks()
+	if err != nil {
+		logrus.Warnf("error listing networks to remove unused certificates: %s", err)
+		return
+	}
+	used := map[string]bool{}
+	for _, n := range networks {
+		for _, variable := range []string{"ca_cert", "client_cert", "private_key"} {
+			if fn, err := client.GetNetwork(n.ID, variable); err == nil {
+				used[wpa.Unquote(fn)] = true
+			}
+		}
+	}
+	for _, fn := range files {
+		if used[fn] {
+			continue
+		}
+		err := os.Remove(fn)
+		if err != nil {
+			logrus.Warnf("error removing unused certificate: %s", err)
+		}
+	}
+}
+
+// enterpriseSettings stores the certificates in e and returns the wpa_supplicant network variables.
+func (a *Ap) enterpriseSettings(ssid string, e *EnterpriseConfig) ([]setting, error) {
+	if e == nil {
+		return nil, fmt.Errorf("missing enterprise config")
+	}
+	err := e.validate()
+	if err != nil {
+		return nil, err
+	}
+
+	settings := []setting{
+		{"key_mgmt", "WPA-EAP"},
+		{"ieee80211w", "1"},
+		{"eap", e.EAP},
+		{"identity", wpa.Quote(e.Identity)},
+	}
+	if e.AnonymousIdentity != "" {
+		settings = append(settings, setting{"anonymous_identity", wpa.Quote(e.AnonymousIdentity)})
+	}
+	if e.EAP != "TLS" {
+		phase2 := e.Phase2
+		if phase2 == "" {
+			phase2 = "MSCHAPV2"
+		}
+		settings = append(settings,
+			setting{"password", wpa.Quote(e.Password)},
+			setting{"phase2", wpa.Quote("auth=" + strings.ToUpper(phase2))},
+		)
+	}
+
+	certs := []struct {
+		name     string
+		content  string
+		variable string
+	}{
+		{"ca", e.CACert, "ca_cert"},
+		{"client", e.ClientCert, "client_cert"},
+		{"key", e.PrivateKey, "private_key"},
+	}
+	for _, c := range certs {
+		if c.content == "" {
+			continue
+		}
+		fn, err := a.writeCert(ssid, c.name, c.content)
+		if err != nil {
+			return nil, err
+		}
+		settings = append(settings, setting{c.variable, wpa.Quote(fn)})
+	}
+	if e.PrivateKeyPassword != "" {
+		settings = append(settings, setting{"private_key_passwd", wpa.Quote(e.PrivateKeyPassword)})
+	}
+
+	return settings, nil
+}
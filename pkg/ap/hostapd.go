@@ -0,0 +1,313 @@
+package ap
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/nergy-se/wificonfig/pkg/wpa"
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v2"
+)
+
+const hostapdCtrlDir = "/var/run/hostapd"
+
+const (
+	Band24GHz = "2.4GHz"
+	Band5GHz  = "5GHz"
+)
+
+// Hostapd supervises a hostapd process running our AP on a virtual interface next to the station interface.
+// Unlike SupplicantAP it gives control over band, channel, max clients and client isolation.
+type Hostapd struct {
+	cmd *exec.Cmd
+
+	WifiInterfaceName string
+	Interface         string
+	configFile        string
+	ssid              string
+	psk               string
+	country           *Country
+	Band              string
+	Channel           int
+	HwMode            string
+	ChannelWidth      int // MHz
+	MaxClients        int
+	Hidden            bool
+	Isolate           bool
+
+	mutex sync.Mutex
+}
+
+func NewHostapd(c *cli.Context, country *Country) *Hostapd {
+	return &Hostapd{
+		WifiInterfaceName: c.String("wifi-interface"),
+		Interface:         c.String("ap-interface"),
+		configFile:        filepath.Join(c.String("data-dir"), "hostapd.conf"),
+		ssid:              c.String("ap-ssid"),
+		psk:               c.String("ap-psk"),
+		country:           country,
+		Band:              c.String("ap-band"),
+		Channel:           c.Int("ap-channel"),
+		HwMode:            c.String("ap-hw-mode"),
+		ChannelWidth:      c.Int("ap-channel-width"),
+		MaxClients:        c.Int("ap-max-clients"),
+		Hidden:            c.Bool("ap-hidden"),
+		Isolate:           c.Bool("ap-isolate"),
+	}
+}
+
+// Validate checks that band, channel, channel width and hw_mode fit together.
+func (h *Hostapd) Validate() error {
+	switch h.Band {
+	case Band24GHz:
+		if h.Channel < 1 || h.Channel > 14 {
+			return fmt.Errorf("channel %d is not a %s channel", h.Channel, h.Band)
+		}
+		if h.HwMode != "" && h.HwMode != "b" && h.HwMode != "g" {
+			return fmt.Errorf("hw_mode %s is not valid for %s", h.HwMode, h.Band)
+		}
+	case Band5GHz:
+		if h.Channel < 36 || h.Channel > 177 {
+			return fmt.Errorf("channel %d is not a %s channel", h.Channel, h.Band)
+		}
+		if h.HwMode != "" && h.HwMode != "a" {
+			return fmt.Errorf("hw_mode %s is not valid for %s", h.HwMode, h.Band)
+		}
+	default:
+		return fmt.Errorf("unknown band %s, valid bands are %s and %s", h.Band, Band24GHz, Band5GHz)
+	}
+	switch h.ChannelWidth {
+	case 0, 20, 40, 80:
+	default:
+		return fmt.Errorf("unknown channel width %d, valid widths are 20, 40 and 80", h.ChannelWidth)
+	}
+	if h.channelWidth() != h.ChannelWidth {
+		return fmt.Errorf("channel %d cannot be %d MHz wide", h.Channel, h.ChannelWidth)
+	}
+	if h.MaxClients < 0 {
+		return fmt.Errorf("max clients must not be negative")
+	}
+	return ValidatePSK(h.psk)
+}
+
+// channelWidth returns ChannelWidth or the widest narrower width the channel supports. The channel can change
+// after Validate with auto channel or when following the station.
+func (h *Hostapd) channelWidth() int {
+	width := h.ChannelWidth
+	if width >= 80 && (h.Band != Band5GHz || vht80CenterChannel(h.Channel) == 0) {
+		width = 40
+	}
+	if width >= 40 && ht40(h.Channel) == "" {
+		width = 20
+	}
+	return width
+}
+
+// ht40 returns the ht_capab of a 40 MHz channel, [HT40+] if the secondary channel is above channel and [HT40-]
+// if it is below. It is empty if channel has no secondary channel.
+func ht40(channel int) string {
+	switch {
+	case channel >= 1 && channel <= 7:
+		return "[HT40+]"
+	case channel >= 8 && channel <= 13:
+		return "[HT40-]"
+	case channel >= 36 && channel <= 144 && (channel-36)%4 == 0:
+		if (channel-36)/4%2 == 0 {
+			return "[HT40+]"
+		}
+		return "[HT40-]"
+	case channel >= 149 && channel <= 161 && (channel-149)%4 == 0:
+		if (channel-149)/4%2 == 0 {
+			return "[HT40+]"
+		}
+		return "[HT40-]"
+	}
+	return ""
+}
+
+// vht80CenterChannel returns the center channel of the 80 MHz block of a 5GHz channel, or 0 if it has none.
+func vht80CenterChannel(channel int) int {
+	switch {
+	case channel >= 36 && channel <= 144 && (channel-36)%4 == 0:
+		return 36 + (channel-36)/16*16 + 6
+	case channel >= 149 && channel <= 161 && (channel-149)%4 == 0:
+		return 155
+	}
+	return 0
+}
+
+// SetChannel sets the channel used the next time the AP is started. The band follows the channel since an AP
+// sharing the channel of the station can end up on the other band.
+func (h *Hostapd) SetChannel(channel int) {
+	h.Channel = channel
+	switch {
+	case channel > 14 && h.Band != Band5GHz:
+		h.Band = Band5GHz
+		h.HwMode = ""
+	case channel <= 14 && h.Band != Band24GHz:
+		h.Band = Band24GHz
+		h.HwMode = ""
+	}
+}
+
+// SetPSK sets the passphrase used the next time the AP is started.
+func (h *Hostapd) SetPSK(psk string) {
+	h.psk = psk
+}
+
+func (h *Hostapd) hwMode() string {
+	if h.HwMode != "" {
+		return h.HwMode
+	}
+	if h.Band == Band5GHz {
+		return "a"
+	}
+	return "g"
+}
+
+// config returns the hostapd.conf content for our flags.
+func (h *Hostapd) config() string {
+	ssid := "ssid=" + h.ssid
+	if quoted := wpa.Quote(h.ssid); !strings.HasPrefix(quoted, "\"") { // ssid2 takes the hex form
+		ssid = "ssid2=" + quoted
+	}
+	lines := []string{
+		"interface=" + h.Interface,
+		"driver=nl80211",
+		"ctrl_interface=" + hostapdCtrlDir,
+		ssid,
+		"country_code=" + h.country.Code(),
+		"ieee80211d=1",
+		"hw_mode=" + h.hwMode(),
+		fmt.Sprintf("channel=%d", h.Channel),
+		"ieee80211n=1",
+		"wmm_enabled=1",
+	}
+	if h.Band == Band5GHz {
+		lines = append(lines, "ieee80211ac=1")
+	}
+	switch h.channelWidth() {
+	case 80:
+		lines = append(lines,
+			"ht_capab="+ht40(h.Channel),
+			"vht_oper_chwidth=1",
+			fmt.Sprintf("vht_oper_centr_freq_seg0_idx=%d", vht80CenterChannel(h.Channel)),
+		)
+	case 40:
+		lines = append(lines, "ht_capab="+ht40(h.Channel))
+	}
+	lines = append(lines,
+		"auth_algs=1",
+		"wpa=2",
+		"wpa_key_mgmt=WPA-PSK",
+		"rsn_pairwise=CCMP",
+		"wpa_passphrase="+h.psk,
+	)
+	if h.Hidden {
+		lines = append(lines, "ignore_broadcast_ssid=1")
+	}
+	if h.MaxClients > 0 {
+		lines = append(lines, fmt.Sprintf("max_num_sta=%d", h.MaxClients))
+	}
+	if h.Isolate {
+		lines = append(lines, "ap_isolate=1")
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+func (h *Hostapd) Cmd() *exec.Cmd {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return h.cmd
+}
+
+func (h *Hostapd) Running() bool {
+	return h.Cmd() != nil
+}
+
+func (h *Hostapd) Stop() error {
+	if cmd := h.Cmd(); cmd != nil {
+		logrus.Debug("stopping hostapd")
+		return cmd.Process.Signal(syscall.SIGTERM)
+	}
+	return nil
+}
+
+// Start creates the AP interface if needed, writes hostapd.conf and starts hostapd.
+func (h *Hostapd) Start(ctx context.Context) error {
+	if h.Cmd() != nil {
+		return nil // already running
+	}
+
+	err := ensureAPInterface(h.WifiInterfaceName, h.Interface)
+	if err != nil {
+		return err
+	}
+
+	err = os.WriteFile(h.configFile, []byte(h.config()), 0600)
+	if err != nil {
+		return err
+	}
+
+	logrus.Debugf("starting: hostapd %s", h.configFile)
+	cmd := exec.CommandContext(ctx, "hostapd", h.configFile)
+	cmdReader, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+
+	scanner := bufio.NewScanner(cmdReader)
+	go func() {
+		for scanner.Scan() {
+			logrus.Infof("hostapd said: %s", scanner.Text())
+		}
+	}()
+	err = cmd.Start()
+	if err != nil {
+		return fmt.Errorf("error starting hostapd: %w", err)
+	}
+	h.mutex.Lock()
+	h.cmd = cmd
+	h.mutex.Unlock()
+	go func() {
+		err := cmd.Wait()
+		if err != nil {
+			logrus.Error(err)
+		}
+
+		h.mutex.Lock()
+		h.cmd = nil
+		h.mutex.Unlock()
+	}()
+	return nil
+}
+
+// IsUp reports if hostapd has enabled the AP. It is false if hostapd is not running.
+func (h *Hostapd) IsUp() (bool, error) {
+	if !h.Running() {
+		return false, nil
+	}
+	client, err := wpa.Dial(hostapdCtrlDir, h.Interface)
+	if err != nil {
+		return false, err
+	}
+	defer client.Close()
+
+	status, err := client.Status()
+	if err != nil {
+		return false, err
+	}
+	return status.Fields["state"] == "ENABLED", nil
+}
+
+// WatchWpaEvents calls fn for every hostapd event until ctx is done.
+func (h *Hostapd) WatchWpaEvents(ctx context.Context, fn func(*wpa.Event)) {
+	watchEvents(ctx, hostapdCtrlDir, h.Interface, fn)
+}
@@ -0,0 +1,65 @@
+package ap
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Lease is an address handed out to a client of our AP.
+type Lease struct {
+	MAC      string    `json:"mac"`
+	IP       string    `json:"ip"`
+	Hostname string    `json:"hostname"`
+	Expiry   time.Time `json:"expiry"` // zero for infinite leases
+}
+
+// ParseLeases parses a dnsmasq lease file. Every line is `<expiry> <mac> <ip> <hostname> <client-id>` where
+// expiry is unix seconds or 0 for infinite and unknown values are *. DHCPv6 lines are skipped.
+func ParseLeases(r io.Reader) ([]*Lease, error) {
+	leases := []*Lease{}
+	scanner := bufio.NewScanner(r)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || fields[0] == "duid" {
+			continue
+		}
+		if len(fields) < 4 {
+			return nil, fmt.Errorf("invalid lease at line %d: %s", lineNo, scanner.Text())
+		}
+		if strings.Contains(fields[2], ":") {
+			continue // DHCPv6
+		}
+
+		expiry, err := strconv.ParseInt(fields[0], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid lease expiry at line %d: %w", lineNo, err)
+		}
+		lease := &Lease{
+			MAC: fields[1],
+			IP:  fields[2],
+		}
+		if expiry != 0 {
+			lease.Expiry = time.Unix(expiry, 0)
+		}
+		if fields[3] != "*" {
+			lease.Hostname = fields[3]
+		}
+		leases = append(leases, lease)
+	}
+	return leases, scanner.Err()
+}
+
+// activeLeases returns the leases that have not expired at now.
+func activeLeases(leases []*Lease, now time.Time) []*Lease {
+	active := []*Lease{}
+	for _, l := range leases {
+		if l.Expiry.IsZero() || l.Expiry.After(now) {
+			active = append(active, l)
+		}
+	}
+	return active
+}
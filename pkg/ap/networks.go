@@ -0,0 +1,349 @@
+package ap
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/nergy-se/wificonfig/pkg/wpa"
+	"github.com/sirupsen/logrus"
+)
+
+const basePriority = 10
+
+var ErrNetworkNotFound = errors.New("network not found")
+
+// SavedNetwork is a client network stored in wpa_supplicant.conf. The PSK is never exposed.
+type SavedNetwork struct {
+	ID       string `json:"id"`
+	SSID     string `json:"ssid"`
+	Priority int    `json:"priority"`
+	Disabled bool   `json:"disabled"`
+	Current  bool   `json:"current"`
+	Hidden   bool   `json:"hidden"`
+}
+
+// SavedNetworks returns all client networks, highest priority first. Our own AP network is not included.
+func (a *Ap) SavedNetworks() ([]*SavedNetwork, error) {
+	client, err := a.wpa()
+	if err != nil {
+		return nil, err
+	}
+	return savedNetworks(client)
+}
+
+func savedNetworks(client *wpa.Client) ([]*SavedNetwork, error) {
+	networks, err := client.ListNetworks()
+	if err != nil {
+		return nil, err
+	}
+
+	saved := []*SavedNetwork{}
+	for _, n := range networks {
+		if isAPNetwork(client, n.ID) {
+			continue
+		}
+
+		s := &SavedNetwork{
+			ID:       n.ID,
+			SSID:     n.SSID,
+			Disabled: n.Disabled,
+			Current:  n.Current,
+		}
+		priority, err := client.GetNetwork(n.ID, "priority")
+		if err != nil {
+			return nil, err
+		}
+		s.Priority, _ = strconv.Atoi(strings.TrimSpace(priority))
+		scanSSID, err := client.GetNetwork(n.ID, "scan_ssid")
+		if err != nil {
+			return nil, err
+		}
+		s.Hidden = strings.TrimSpace(scanSSID) == "1"
+		saved = append(saved, s)
+	}
+
+	sort.SliceStable(saved, func(i, j int) bool {
+		return saved[i].Priority > saved[j].Priority
+	})
+	return saved, nil
+}
+
+// isAPNetwork reports if network id is our mode=2 AP network.
+func isAPNetwork(client *wpa.Client, id string) bool {
+	mode, err := client.GetNetwork(id, "mode")
+	return err == nil && strings.TrimSpace(mode) == "2"
+}
+
+func findNetwork(saved []*SavedNetwork, id string) *SavedNetwork {
+	for _, s := range saved {
+		if s.ID == id {
+			return s
+		}
+	}
+	return nil
+}
+
+func nextPriority(saved []*SavedNetwork) int {
+	if len(saved) == 0 || saved[0].Priority < basePriority {
+		return basePriority
+	}
+	return saved[0].Priority + 1
+}
+
+// ValidatePSK checks that psk is a valid WPA passphrase, 8 to 63 printable ASCII characters.
+func ValidatePSK(psk string) error {
+	if len(psk) < 8 || len(psk) > 63 {
+		return fmt.Errorf("password must be between 8 and 63 characters")
+	}
+	for _, c := range []byte(psk) {
+		if c < 0x20 || c > 0x7e {
+			return fmt.Errorf("password must only contain printable ASCII characters")
+		}
+	}
+	return nil
+}
+
+// NetworkConfig is what the user can configure for a client network. Empty values are left unchanged on update.
+type NetworkConfig struct {
+	SSID     string   `json:"ssid"`
+	PSK      string   `json:"psk"`
+	Security Security `json:"security"` // inferred from scan results if empty
+	Priority int      `json:"priority"`
+	Hidden   *bool    `json:"hidden"` // probe for the ssid since it is not broadcasted
+
+	Enterprise *EnterpriseConfig `json:"enterprise"` // used when Security is wpa2-enterprise
+}
+
+// AddNetwork saves a new network. If priority is 0 it gets the highest priority.
+func (a *Ap) AddNetwork(cfg NetworkConfig) (string, error) {
+	client, err := a.wpa()
+	if err != nil {
+		return "", err
+	}
+	defer a.pruneCerts(client, cfg.SSID)
+
+	if cfg.Priority == 0 {
+		saved, err := savedNetworks(client)
+		if err != nil {
+			return "", err
+		}
+		cfg.Priority = nextPriority(saved)
+	}
+
+	id, err := a.addNetwork(client, cfg)
+	if err != nil {
+		return "", err
+	}
+	return id, client.SaveConfig()
+}
+
+func (a *Ap) addNetwork(client *wpa.Client, cfg NetworkConfig) (string, error) {
+	if cfg.SSID == "" {
+		return "", fmt.Errorf("missing ssid")
+	}
+	if cfg.Security == "" && cfg.Enterprise != nil {
+		cfg.Security = SecurityEnterprise
+	}
+	if cfg.Security == "" {
+		cfg.Security = securityFromScan(client, cfg.SSID, cfg.PSK)
+	}
+
+	id, err := client.AddNetwork()
+	if err != nil {
+		return "", err
+	}
+	logrus.Infof("add_network: %s", id)
+
+	err = a.updateNetwork(client, id, cfg)
+	if err != nil {
+		_ = client.RemoveNetwork(id)
+		return "", err
+	}
+	return id, nil
+}
+
+// securityFromScan looks up ssid in the latest scan results. If it is not found we guess from
+// if we got a password or not.
+func securityFromScan(client *wpa.Client, ssid, psk string) Security {
+	results, err := client.ScanResults()
+	if err != nil {
+		logrus.Warnf("error getting scan results: %s", err)
+	}
+	for _, r := range results {
+		if r.SSID != ssid {
+			continue
+		}
+		if s := SecurityFromFlags(r.Flags); s != "" {
+			return s
+		}
+	}
+
+	if psk == "" {
+		return SecurityOpen
+	}
+	return SecurityWPA2
+}
+
+// UpdateNetwork changes a saved network.
+func (a *Ap) UpdateNetwork(id string, cfg NetworkConfig) error {
+	client, err := a.wpa()
+	if err != nil {
+		return err
+	}
+
+	saved, err := savedNetworks(client)
+	if err != nil {
+		return err
+	}
+	n := findNetwork(saved, id)
+	if n == nil {
+		return ErrNetworkNotFound
+	}
+	defer a.pruneCerts(client, n.SSID)
+	ssid := cfg.SSID
+	if ssid == "" {
+		ssid = n.SSID
+	} else if ssid != n.SSID {
+		defer a.pruneCerts(client, ssid)
+	}
+	updateSecurity(client, ssid, &cfg)
+
+	err = a.updateNetwork(client, id, cfg)
+	if err != nil {
+		return err
+	}
+	return client.SaveConfig()
+}
+
+// updateSecurity infers cfg.Security when a saved network with ssid gets new credentials. It is left empty,
+// keeping the current security settings, if cfg has neither a password nor enterprise credentials.
+func updateSecurity(client *wpa.Client, ssid string, cfg *NetworkConfig) {
+	if cfg.Security == "" && cfg.Enterprise != nil {
+		cfg.Security = SecurityEnterprise
+	}
+	if cfg.PSK != "" && cfg.Security == "" {
+		cfg.Security = securityFromScan(client, ssid, cfg.PSK)
+	}
+}
+
+// updateNetwork sets the non empty values of cfg. Security settings are only changed together
+// with cfg.Security.
+func (a *Ap) updateNetwork(client *wpa.Client, id string, cfg NetworkConfig) error {
+	settings := []setting{}
+
+	if cfg.SSID != "" {
+		settings = append(settings, setting{"ssid", wpa.Quote(cfg.SSID)})
+	}
+	switch cfg.Security {
+	case "":
+	case SecurityEnterprise:
+		ssid, err := networkSSID(client, id, cfg.SSID)
+		if err != nil {
+			return err
+		}
+		s, err := a.enterpriseSettings(ssid, cfg.Enterprise)
+		if err != nil {
+			return err
+		}
+		settings = append(settings, s...)
+	default:
+		s, err := securitySettings(cfg.Security, cfg.PSK)
+		if err != nil {
+			return err
+		}
+		settings = append(settings, s...)
+	}
+	if cfg.Security != "" {
+		unsetStaleSecurity(client, id, settings)
+	}
+	if cfg.Priority != 0 {
+		settings = append(settings, setting{"priority", strconv.Itoa(cfg.Priority)})
+	}
+	if cfg.Hidden != nil {
+		scanSSID := "0"
+		if *cfg.Hidden {
+			scanSSID = "1"
+		}
+		settings = append(settings, setting{"scan_ssid", scanSSID})
+	}
+
+	for _, s := range settings {
+		err := client.SetNetwork(id, s.variable, s.value)
+		if err != nil {
+			return err
+		}
+	}
+
+	return client.EnableNetwork(id)
+}
+
+// ReorderNetworks sets priorities so that ids[0] is preferred. ids must contain every saved network.
+func (a *Ap) ReorderNetworks(ids []string) error {
+	client, err := a.wpa()
+	if err != nil {
+		return err
+	}
+
+	saved, err := savedNetworks(client)
+	if err != nil {
+		return err
+	}
+	if len(ids) != len(saved) {
+		return fmt.Errorf("expected %d network ids got %d", len(saved), len(ids))
+	}
+	for _, s := range saved {
+		if !slices.Contains(ids, s.ID) {
+			return fmt.Errorf("network %s missing in new order", s.ID)
+		}
+	}
+
+	for i, id := range ids {
+		err := client.SetNetwork(id, "priority", strconv.Itoa(basePriority+len(ids)-1-i))
+		if err != nil {
+			return err
+		}
+	}
+	return client.SaveConfig()
+}
+
+func (a *Ap) RemoveNetwork(id string) error {
+	client, err := a.wpa()
+	if err != nil {
+		return err
+	}
+
+	saved, err := savedNetworks(client)
+	if err != nil {
+		return err
+	}
+	n := findNetwork(saved, id)
+	if n == nil {
+		return ErrNetworkNotFound
+	}
+
+	err = client.RemoveNetwork(id)
+	if err != nil {
+		return err
+	}
+	err = client.SaveConfig()
+	if err != nil {
+		return err
+	}
+	return a.removeCerts(n.SSID)
+}
+
+// networkSSID returns ssid if set otherwise the ssid currently configured for network id.
+func networkSSID(client *wpa.Client, id, ssid string) (string, error) {
+	if ssid != "" {
+		return ssid, nil
+	}
+	current, err := client.GetNetwork(id, "ssid")
+	if err != nil {
+		return "", err
+	}
+	return wpa.Unquote(current), nil
+}
@@ -0,0 +1,95 @@
+package ap
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/nergy-se/wificonfig/pkg/wpa"
+	"github.com/sirupsen/logrus"
+)
+
+type Security string
+
+const (
+	SecurityOpen       Security = "open"
+	SecurityWPA2       Security = "wpa2"
+	SecurityWPA3       Security = "wpa3"
+	SecurityTransition Security = "wpa2-wpa3"
+)
+
+// SecurityFromFlags infers the security mode from scan result flags like [WPA2-PSK+SAE-CCMP][ESS].
+// Returns "" for networks we do not know how to join.
+func SecurityFromFlags(flags string) Security {
+	psk := strings.Contains(flags, "PSK")
+	sae := strings.Contains(flags, "SAE")
+	switch {
+	case strings.Contains(flags, "EAP"):
+		return SecurityEnterprise
+	case psk && sae:
+		return SecurityTransition
+	case sae:
+		return SecurityWPA3
+	case psk:
+		return SecurityWPA2
+	case !strings.Contains(flags, "WPA") && !strings.Contains(flags, "WEP") && !strings.Contains(flags, "RSN") && !strings.Contains(flags, "OWE"):
+		return SecurityOpen
+	}
+	return ""
+}
+
+type setting struct {
+	variable string
+	value    string
+}
+
+// securityVariables are the network variables holding credentials of one of the security modes.
+var securityVariables = []string{
+	"psk", "sae_password",
+	"eap", "identity", "anonymous_identity", "password", "phase2",
+	"ca_cert", "client_cert", "private_key", "private_key_passwd",
+}
+
+// unsetStaleSecurity unsets the security variables of network id that are set but not in settings, so nothing
+// of the previous security mode is left when it changes. wpa_supplicant unsets string variables set to NULL,
+// the few it cannot unset are not used by the key_mgmt in settings so failures are only logged.
+func unsetStaleSecurity(client *wpa.Client, id string, settings []setting) {
+	for _, variable := range securityVariables {
+		if slices.ContainsFunc(settings, func(s setting) bool { return s.variable == variable }) {
+			continue
+		}
+		if _, err := client.GetNetwork(id, variable); err != nil {
+			continue // not set
+		}
+		err := client.SetNetwork(id, variable, "NULL")
+		if err != nil {
+			logrus.Warnf("error unsetting %s of network %s: %s", variable, id, err)
+		}
+	}
+}
+
+// securitySettings returns the wpa_supplicant network variables for security s.
+func securitySettings(s Security, psk string) ([]setting, error) {
+	switch s {
+	case SecurityOpen:
+		return []setting{{"key_mgmt", "NONE"}, {"ieee80211w", "0"}}, nil
+	case SecurityWPA2:
+		err := ValidatePSK(psk)
+		if err != nil {
+			return nil, err
+		}
+		return []setting{{"key_mgmt", "WPA-PSK"}, {"psk", wpa.QuotePassphrase(psk)}, {"ieee80211w", "0"}}, nil
+	case SecurityWPA3:
+		if psk == "" {
+			return nil, fmt.Errorf("missing password")
+		}
+		return []setting{{"key_mgmt", "SAE"}, {"sae_password", wpa.Quote(psk)}, {"ieee80211w", "2"}}, nil
+	case SecurityTransition:
+		err := ValidatePSK(psk)
+		if err != nil {
+			return nil, err
+		}
+		return []setting{{"key_mgmt", "WPA-PSK SAE"}, {"psk", wpa.QuotePassphrase(psk)}, {"ieee80211w", "1"}}, nil
+	}
+	return nil, fmt.Errorf("unsupported security: %s", s)
+}
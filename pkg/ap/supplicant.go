@@ -0,0 +1,164 @@
+package ap
+
+import (
+	"bufio"
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/nergy-se/wificonfig/pkg/wpa"
+	"github.com/sirupsen/logrus"
+)
+
+// supplicant supervises one wpa_supplicant process and our connection to its control socket.
+type supplicant struct {
+	iface      string
+	configFile string
+	ctrlDir    string
+	// onDial is called with every new control connection, before it is used.
+	onDial func(*wpa.Client)
+
+	cmd    *exec.Cmd
+	client *wpa.Client
+
+	mutex sync.Mutex
+}
+
+func (s *supplicant) Cmd() *exec.Cmd {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.cmd
+}
+
+func (s *supplicant) Running() bool {
+	return s.Cmd() != nil
+}
+
+func (s *supplicant) Stop() error {
+	if cmd := s.Cmd(); cmd != nil {
+		logrus.Debugf("stopping wpa_supplicant on %s", s.iface)
+		return cmd.Process.Signal(os.Interrupt)
+	}
+	return nil
+}
+
+func (s *supplicant) Start(ctx context.Context) error {
+	if s.Cmd() != nil {
+		return nil
+	}
+
+	logrus.Debugf("starting wpa_supplicant on %s", s.iface)
+
+	args := []string{
+		"-Dnl80211",
+		"-i" + s.iface,
+		"-c" + s.configFile,
+	}
+
+	logrus.Debug(append([]string{"starting: wpa_supplicant"}, args...))
+	cmd := exec.CommandContext(ctx, "wpa_supplicant", args...)
+	cmdReader, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+
+	scanner := bufio.NewScanner(cmdReader)
+	go func() {
+		for scanner.Scan() {
+			logrus.Infof("wpa_supplicant said: %s\n", scanner.Text())
+		}
+	}()
+	err = cmd.Start()
+	if err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	s.cmd = cmd
+	s.mutex.Unlock()
+
+	go func() {
+		err := cmd.Wait()
+		if err != nil {
+			logrus.Error(err)
+		}
+
+		s.close()
+
+		s.mutex.Lock()
+		s.cmd = nil
+		s.mutex.Unlock()
+	}()
+
+	return err
+}
+
+func (s *supplicant) wpa() (*wpa.Client, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.client != nil {
+		return s.client, nil
+	}
+
+	client, err := wpa.Dial(s.ctrlDir, s.iface)
+	if err != nil {
+		return nil, err
+	}
+	if s.onDial != nil {
+		s.onDial(client)
+	}
+	s.client = client
+	return client, nil
+}
+
+func (s *supplicant) close() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.client == nil {
+		return
+	}
+	err := s.client.Close()
+	if err != nil {
+		logrus.Error(err)
+	}
+	s.client = nil
+}
+
+func (s *supplicant) status() (*wpa.Status, error) {
+	client, err := s.wpa()
+	if err != nil {
+		return nil, err
+	}
+	return client.Status()
+}
+
+// WatchEvents calls fn for every wpa_supplicant event until ctx is done.
+// It reconnects whenever wpa_supplicant is (re)started.
+func (s *supplicant) WatchEvents(ctx context.Context, fn func(*wpa.Event)) {
+	watchEvents(ctx, s.ctrlDir, s.iface, fn)
+}
+
+// watchEvents attaches to the control socket of iface in ctrlDir and calls fn for every event until ctx is done.
+// hostapd uses the same control protocol as wpa_supplicant.
+func watchEvents(ctx context.Context, ctrlDir, iface string, fn func(*wpa.Event)) {
+	for {
+		client, err := wpa.Dial(ctrlDir, iface)
+		if err == nil {
+			logrus.Debugf("attached to events on %s", filepath.Join(ctrlDir, iface))
+			err = client.Events(ctx, fn)
+			client.Close()
+			if err != nil && ctx.Err() == nil {
+				logrus.Warnf("events from %s: %s", iface, err)
+			}
+		}
+
+		select {
+		case <-time.After(time.Second):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
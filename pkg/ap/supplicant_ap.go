@@ -0,0 +1,115 @@
+package ap
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/nergy-se/wificonfig/pkg/wpa"
+	"github.com/urfave/cli/v2"
+)
+
+// SupplicantAP runs our AP with a separate wpa_supplicant on a virtual interface next to the station interface,
+// so the portal stays reachable while the station connects. Only use it if SupportsConcurrentAP reports true.
+type SupplicantAP struct {
+	ap *supplicant
+
+	WifiInterfaceName string
+	Interface         string
+	ssid              string
+	psk               string
+	country           *Country
+	frequency         int
+}
+
+func NewSupplicantAP(c *cli.Context, country *Country) *SupplicantAP {
+	iface := c.String("ap-interface")
+	return &SupplicantAP{
+		ap: &supplicant{
+			iface:      iface,
+			configFile: filepath.Join(filepath.Dir(c.String("wpa-supplicant-config")), "wpa_supplicant-"+iface+".conf"),
+			ctrlDir:    wpa.DefaultCtrlDir,
+		},
+		WifiInterfaceName: c.String("wifi-interface"),
+		Interface:         iface,
+		ssid:              c.String("ap-ssid"),
+		psk:               c.String("ap-psk"),
+		country:           country,
+		frequency:         ChannelFrequency(c.Int("ap-channel")),
+	}
+}
+
+// SetChannel sets the channel used the next time the AP is started.
+func (c *SupplicantAP) SetChannel(channel int) {
+	c.frequency = ChannelFrequency(channel)
+}
+
+// SetPSK sets the passphrase used the next time the AP is started.
+func (c *SupplicantAP) SetPSK(psk string) {
+	c.psk = psk
+}
+
+// Start creates the AP interface if needed and starts wpa_supplicant on it with only our AP network.
+func (c *SupplicantAP) Start(ctx context.Context) error {
+	if c.ap.Running() {
+		return nil
+	}
+
+	err := ensureAPInterface(c.WifiInterfaceName, c.Interface)
+	if err != nil {
+		return err
+	}
+
+	err = c.writeConfig()
+	if err != nil {
+		return err
+	}
+
+	return c.ap.Start(ctx)
+}
+
+func (c *SupplicantAP) Stop() error {
+	return c.ap.Stop()
+}
+
+func (c *SupplicantAP) Running() bool {
+	return c.ap.Running()
+}
+
+// IsUp reports if the AP is enabled. It is false if wpa_supplicant is not running on the AP interface.
+func (c *SupplicantAP) IsUp() (bool, error) {
+	if !c.ap.Running() {
+		return false, nil
+	}
+	status, err := c.ap.status()
+	if err != nil {
+		return false, err
+	}
+	return status.Mode == "AP" && status.WpaState == "COMPLETED", nil
+}
+
+// WatchWpaEvents calls fn for every event from the AP interface wpa_supplicant until ctx is done.
+func (c *SupplicantAP) WatchWpaEvents(ctx context.Context, fn func(*wpa.Event)) {
+	c.ap.WatchEvents(ctx, fn)
+}
+
+// writeConfig writes a wpa_supplicant config only containing our AP network. It is regenerated on
+// every start so it always matches our flags.
+func (c *SupplicantAP) writeConfig() error {
+	content := fmt.Sprintf(`ctrl_interface=/var/run/wpa_supplicant
+ctrl_interface_group=0
+update_config=0
+country=%s
+ap_scan=2
+
+network={
+	ssid=%s
+	psk=%s
+	key_mgmt=WPA-PSK
+	mode=2
+	frequency=%d
+}
+`, c.country.Code(), wpa.Quote(c.ssid), wpa.QuotePassphrase(c.psk), c.frequency)
+	return os.WriteFile(c.ap.configFile, []byte(content), 0600)
+}
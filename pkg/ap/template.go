@@ -0,0 +1,117 @@
+package ap
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var placeholderRe = regexp.MustCompile(`\{([a-z-]+?)(\d*)\}`)
+
+// DeviceInfo resolves --ap-ssid and --ap-psk templates with per device values:
+//
+//	{mac}         MAC address of the wifi interface without colons
+//	{hostname}    hostname
+//	{machine-id}  /etc/machine-id
+//	{serial}      Raspberry Pi serial number from /proc/cpuinfo
+//
+// A number after the name keeps only the last characters, for example {mac4} or {serial8}.
+type DeviceInfo struct {
+	WifiInterfaceName string
+	MachineIDFile     string
+	CPUInfoFile       string
+
+	hardwareAddr func(iface string) (net.HardwareAddr, error)
+	hostname     func() (string, error)
+}
+
+func NewDeviceInfo(wifiInterfaceName string) *DeviceInfo {
+	return &DeviceInfo{
+		WifiInterfaceName: wifiInterfaceName,
+		MachineIDFile:     "/etc/machine-id",
+		CPUInfoFile:       "/proc/cpuinfo",
+		hardwareAddr: func(iface string) (net.HardwareAddr, error) {
+			i, err := net.InterfaceByName(iface)
+			if err != nil {
+				return nil, err
+			}
+			return i.HardwareAddr, nil
+		},
+		hostname: os.Hostname,
+	}
+}
+
+// Resolve replaces all placeholders in tmpl. Unknown placeholders are an error.
+func (d *DeviceInfo) Resolve(tmpl string) (string, error) {
+	var err error
+	resolved := placeholderRe.ReplaceAllStringFunc(tmpl, func(placeholder string) string {
+		if err != nil {
+			return ""
+		}
+		m := placeholderRe.FindStringSubmatch(placeholder)
+		var value string
+		value, err = d.value(m[1])
+		if err != nil {
+			err = fmt.Errorf("error resolving %s: %w", placeholder, err)
+			return ""
+		}
+		if m[2] != "" {
+			n, _ := strconv.Atoi(m[2])
+			if n < len(value) {
+				value = value[len(value)-n:]
+			}
+		}
+		return value
+	})
+	return resolved, err
+}
+
+func (d *DeviceInfo) value(name string) (string, error) {
+	switch name {
+	case "mac":
+		addr, err := d.hardwareAddr(d.WifiInterfaceName)
+		if err != nil {
+			return "", err
+		}
+		if len(addr) == 0 {
+			return "", fmt.Errorf("%s has no MAC address", d.WifiInterfaceName)
+		}
+		return strings.ReplaceAll(addr.String(), ":", ""), nil
+	case "hostname":
+		return d.hostname()
+	case "machine-id":
+		data, err := os.ReadFile(d.MachineIDFile)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(string(data)), nil
+	case "serial":
+		return d.serial()
+	}
+	return "", fmt.Errorf("unknown placeholder")
+}
+
+// serial returns the "Serial" line of /proc/cpuinfo found on Raspberry Pi.
+func (d *DeviceInfo) serial() (string, error) {
+	f, err := os.Open(d.CPUInfoFile)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), ":")
+		if ok && strings.TrimSpace(key) == "Serial" {
+			return strings.TrimSpace(value), nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+	return "", fmt.Errorf("no serial in %s", d.CPUInfoFile)
+}
@@ -0,0 +1,195 @@
+// Package captive answers the connectivity probes operating systems send when joining a network. While we are
+// in setup mode the probes are redirected to the portal so the OS opens its sign-in sheet, once provisioned they
+// get the answer the OS expects from the internet so phones stop asking the user to sign in.
+package captive
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+)
+
+// Probe is the connectivity check of an operating system. A request matches if its host and path is exactly one
+// of URLs, the query is ignored.
+type Probe struct {
+	Name string
+	URLs []string
+
+	status      int
+	contentType string
+	body        string
+}
+
+// Probes are the connectivity checks we know about.
+var Probes = []*Probe{
+	{
+		Name:        "apple",
+		URLs:        []string{"captive.apple.com/hotspot-detect.html", "captive.apple.com/", "www.apple.com/library/test/success.html"},
+		status:      http.StatusOK,
+		contentType: "text/html",
+		body:        "<HTML><HEAD><TITLE>Success</TITLE></HEAD><BODY>Success</BODY></HTML>",
+	},
+	{
+		Name: "android",
+		URLs: []string{
+			"connectivitycheck.gstatic.com/generate_204",
+			"connectivitycheck.android.com/generate_204",
+			"www.gstatic.com/generate_204",
+			"clients1.google.com/generate_204",
+			"clients3.google.com/generate_204",
+			"play.googleapis.com/generate_204",
+			"www.google.com/gen_204",
+		},
+		status: http.StatusNoContent,
+	},
+	{
+		Name:   "ubuntu",
+		URLs:   []string{"connectivity-check.ubuntu.com/"},
+		status: http.StatusNoContent,
+	},
+	{
+		Name:        "windows",
+		URLs:        []string{"www.msftconnecttest.com/connecttest.txt", "ipv6.msftconnecttest.com/connecttest.txt", "www.msftconnecttest.com/redirect"},
+		status:      http.StatusOK,
+		contentType: "text/plain",
+		body:        "Microsoft Connect Test",
+	},
+	{
+		Name:        "windows-ncsi",
+		URLs:        []string{"www.msftncsi.com/ncsi.txt", "ipv6.msftncsi.com/ncsi.txt"},
+		status:      http.StatusOK,
+		contentType: "text/plain",
+		body:        "Microsoft NCSI",
+	},
+	{
+		Name:        "firefox",
+		URLs:        []string{"detectportal.firefox.com/canonical.html"},
+		status:      http.StatusOK,
+		contentType: "text/html",
+		body:        `<meta http-equiv="refresh" content="0;url=https://support.mozilla.org/kb/captive-portal"/>`,
+	},
+	{
+		Name:        "firefox-success",
+		URLs:        []string{"detectportal.firefox.com/success.txt"},
+		status:      http.StatusOK,
+		contentType: "text/plain",
+		body:        "success\n",
+	},
+	{
+		Name:        "networkmanager",
+		URLs:        []string{"nmcheck.gnome.org/check_network_status.txt", "network-test.debian.org/nm"},
+		status:      http.StatusOK,
+		contentType: "text/plain",
+		body:        "NetworkManager is online\n",
+	},
+}
+
+// APIPath is where the RFC 8908 captive portal API is served.
+const APIPath = "/api/captive-v1"
+
+// Portal answers probes with a redirect to URL while Captive returns true and with the expected success
+// response otherwise.
+type Portal struct {
+	URL     string
+	Captive func() bool
+}
+
+func New(url string, captive func() bool) *Portal {
+	return &Portal{URL: url, Captive: captive}
+}
+
+// API serves the RFC 8908 captive portal API telling clients if they must visit the portal.
+func (p *Portal) API(w http.ResponseWriter, r *http.Request) {
+	type status struct {
+		Captive       bool   `json:"captive"`
+		UserPortalURL string `json:"user-portal-url,omitempty"`
+	}
+	s := status{Captive: p.Captive()}
+	if s.Captive {
+		s.UserPortalURL = p.URL
+	}
+
+	w.Header().Set("Content-Type", "application/captive+json")
+	w.Header().Set("Cache-Control", "private, no-store")
+	err := json.NewEncoder(w).Encode(s)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// Match returns the probe r is or nil.
+func Match(r *http.Request) *Probe {
+	u := requestHost(r) + r.URL.Path
+	for _, p := range Probes {
+		if slices.Contains(p.URLs, u) {
+			return p
+		}
+	}
+	return nil
+}
+
+// Handle answers r if it is a probe and reports if it did.
+func (p *Portal) Handle(w http.ResponseWriter, r *http.Request) bool {
+	probe := Match(r)
+	if probe == nil {
+		return false
+	}
+
+	// make sure the OS asks again instead of using a cached answer after we are provisioned.
+	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+	w.Header().Set("Pragma", "no-cache")
+	w.Header().Set("Expires", "0")
+
+	if p.Captive() {
+		p.redirect(w, r)
+		return true
+	}
+
+	if probe.contentType != "" {
+		w.Header().Set("Content-Type", probe.contentType)
+	}
+	w.WriteHeader(probe.status)
+	if probe.body != "" && r.Method != http.MethodHead {
+		fmt.Fprint(w, probe.body)
+	}
+	return true
+}
+
+// HandleUnknownHost redirects r to the portal if we are captive and r is for a host other than the portal,
+// which happens since our DNS answers every name with our address. It reports if it did.
+func (p *Portal) HandleUnknownHost(w http.ResponseWriter, r *http.Request) bool {
+	if !p.Captive() {
+		return false
+	}
+	u, err := url.Parse(p.URL)
+	if err != nil || requestHost(r) == strings.ToLower(u.Hostname()) {
+		return false
+	}
+	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+	p.redirect(w, r)
+	return true
+}
+
+// redirect sends the client to the portal. Every OS opens its sign-in sheet when the probe answer is not the
+// expected one, a redirect also makes the sheet show the portal directly.
+func (p *Portal) redirect(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Location", p.URL)
+	w.WriteHeader(http.StatusFound)
+	if r.Method != http.MethodHead {
+		fmt.Fprintf(w, `<html><head><title>Setup</title></head><body><a href="%s">Continue to setup</a></body></html>`, p.URL)
+	}
+}
+
+// requestHost returns the lower case host of r without port.
+func requestHost(r *http.Request) string {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
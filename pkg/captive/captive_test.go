@@ -0,0 +1,153 @@
+package captive
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHandle(t *testing.T) {
+	tests := []struct {
+		url          string
+		captive      bool
+		expected     bool
+		expectedCode int
+		expectedBody string
+	}{
+		{url: "http://captive.apple.com/hotspot-detect.html", captive: true, expected: true, expectedCode: http.StatusFound},
+		{url: "http://captive.apple.com/hotspot-detect.html", expected: true, expectedCode: http.StatusOK, expectedBody: "<HTML><HEAD><TITLE>Success</TITLE></HEAD><BODY>Success</BODY></HTML>"},
+		{url: "http://www.apple.com/library/test/success.html", expected: true, expectedCode: http.StatusOK, expectedBody: "<HTML><HEAD><TITLE>Success</TITLE></HEAD><BODY>Success</BODY></HTML>"},
+		{url: "http://connectivitycheck.gstatic.com/generate_204", captive: true, expected: true, expectedCode: http.StatusFound},
+		{url: "http://connectivitycheck.gstatic.com/generate_204", expected: true, expectedCode: http.StatusNoContent},
+		{url: "http://connectivitycheck.android.com/some/other/check"},
+		{url: "http://connectivity-check.ubuntu.com./", expected: true, expectedCode: http.StatusNoContent},
+		{url: "http://www.msftconnecttest.com/connecttest.txt", expected: true, expectedCode: http.StatusOK, expectedBody: "Microsoft Connect Test"},
+		{url: "http://www.msftconnecttest.com/redirect", captive: true, expected: true, expectedCode: http.StatusFound},
+		{url: "http://www.msftncsi.com/ncsi.txt", expected: true, expectedCode: http.StatusOK, expectedBody: "Microsoft NCSI"},
+		{url: "http://detectportal.firefox.com/canonical.html", captive: true, expected: true, expectedCode: http.StatusFound},
+		{url: "http://detectportal.firefox.com/success.txt?ipv4", expected: true, expectedCode: http.StatusOK, expectedBody: "success\n"},
+		{url: "http://nmcheck.gnome.org/check_network_status.txt", expected: true, expectedCode: http.StatusOK, expectedBody: "NetworkManager is online\n"},
+		{url: "http://192.168.27.1:8080/generate_204", captive: true},
+		{url: "http://192.168.27.1:8080/", captive: true},
+		{url: "http://192.168.27.1:8080/api/status-v1", captive: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.url, func(t *testing.T) {
+			p := New("http://192.168.27.1:8080/", func() bool { return tt.captive })
+			w := httptest.NewRecorder()
+			handled := p.Handle(w, httptest.NewRequest(http.MethodGet, tt.url, nil))
+			if handled != tt.expected {
+				t.Fatalf("expected handled %t got %t", tt.expected, handled)
+			}
+			if !handled {
+				return
+			}
+			if w.Code != tt.expectedCode {
+				t.Errorf("expected status %d got %d", tt.expectedCode, w.Code)
+			}
+			if tt.captive && w.Header().Get("Location") != "http://192.168.27.1:8080/" {
+				t.Errorf("expected redirect to the portal got %q", w.Header().Get("Location"))
+			}
+			if !tt.captive && w.Body.String() != tt.expectedBody {
+				t.Errorf("expected body %q got %q", tt.expectedBody, w.Body.String())
+			}
+			if w.Header().Get("Cache-Control") == "" {
+				t.Errorf("expected probe answers to not be cached")
+			}
+		})
+	}
+}
+
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		url      string
+		expected string
+	}{
+		{"http://captive.apple.com/hotspot-detect.html", "apple"},
+		{"http://CAPTIVE.apple.com:80/hotspot-detect.html", "apple"},
+		{"http://www.apple.com/library/test/success.html", "apple"},
+		{"http://connectivitycheck.gstatic.com/generate_204", "android"},
+		{"http://www.google.com/gen_204", "android"},
+		{"http://www.msftconnecttest.com/connecttest.txt", "windows"},
+		{"http://ipv6.msftncsi.com/ncsi.txt", "windows-ncsi"},
+		{"http://detectportal.firefox.com/canonical.html", "firefox"},
+		{"http://detectportal.firefox.com/success.txt?ipv6", "firefox-success"},
+		{"http://network-test.debian.org/nm", "networkmanager"},
+		{"http://captive.apple.com/generate_204", ""},
+		{"http://connectivitycheck.gstatic.com/hotspot-detect.html", ""},
+		{"http://example.com/success.txt", ""},
+		{"http://example.com/generate_204", ""},
+		{"http://www.apple.com/", ""},
+	}
+
+	for _, tt := range tests {
+		p := Match(httptest.NewRequest(http.MethodGet, tt.url, nil))
+		name := ""
+		if p != nil {
+			name = p.Name
+		}
+		if name != tt.expected {
+			t.Errorf("%s: expected probe %q got %q", tt.url, tt.expected, name)
+		}
+	}
+}
+
+func TestAPI(t *testing.T) {
+	captive := true
+	p := New("http://192.168.27.1:8080/", func() bool { return captive })
+
+	get := func() map[string]any {
+		w := httptest.NewRecorder()
+		p.API(w, httptest.NewRequest(http.MethodGet, APIPath, nil))
+		if ct := w.Header().Get("Content-Type"); ct != "application/captive+json" {
+			t.Errorf("expected application/captive+json got %s", ct)
+		}
+		body := map[string]any{}
+		err := json.Unmarshal(w.Body.Bytes(), &body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return body
+	}
+
+	body := get()
+	if body["captive"] != true || body["user-portal-url"] != "http://192.168.27.1:8080/" {
+		t.Errorf("expected captive with portal url got %v", body)
+	}
+
+	captive = false
+	body = get()
+	if body["captive"] != false || body["user-portal-url"] != nil {
+		t.Errorf("expected not captive got %v", body)
+	}
+}
+
+func TestHandleUnknownHost(t *testing.T) {
+	tests := []struct {
+		url      string
+		captive  bool
+		expected bool
+	}{
+		{url: "http://example.com/some/page", captive: true, expected: true},
+		{url: "http://Example.com./", captive: true, expected: true},
+		{url: "http://192.168.27.1:8080/unknown", captive: true},
+		{url: "http://192.168.27.1/unknown", captive: true},
+		{url: "http://example.com/some/page"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.url, func(t *testing.T) {
+			p := New("http://192.168.27.1:8080/", func() bool { return tt.captive })
+			w := httptest.NewRecorder()
+			handled := p.HandleUnknownHost(w, httptest.NewRequest(http.MethodGet, tt.url, nil))
+			if handled != tt.expected {
+				t.Fatalf("expected handled %t got %t", tt.expected, handled)
+			}
+			if handled && (w.Code != http.StatusFound || w.Header().Get("Location") != "http://192.168.27.1:8080/") {
+				t.Errorf("expected redirect to the portal got %d %q", w.Code, w.Header().Get("Location"))
+			}
+		})
+	}
+}
@@ -0,0 +1,191 @@
+package dhcp
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+var clientMAC = net.HardwareAddr{0xdc, 0xa6, 0x32, 0x12, 0xab, 0xcd}
+
+func newTestLeases(t *testing.T) *Leases {
+	l, err := NewLeases(net.ParseIP("192.168.27.100"), net.ParseIP("192.168.27.102"), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l
+}
+
+func TestMessageRoundTrip(t *testing.T) {
+	m := &Message{
+		Op:     opRequest,
+		XID:    0x12345678,
+		Flags:  flagBroadcast,
+		CIAddr: net.IPv4zero,
+		YIAddr: net.IPv4zero,
+		SIAddr: net.IPv4zero,
+		GIAddr: net.IPv4zero,
+		CHAddr: clientMAC,
+		Options: map[byte][]byte{
+			OptionMessageType: {byte(Discover)},
+			OptionHostname:    []byte("pixel-7"),
+			OptionRequestedIP: net.ParseIP("192.168.27.101").To4(),
+		},
+	}
+
+	got, err := Parse(m.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.XID != m.XID || got.Flags != m.Flags || got.CHAddr.String() != clientMAC.String() {
+		t.Errorf("unexpected header %+v", got)
+	}
+	if got.Type() != Discover || string(got.Options[OptionHostname]) != "pixel-7" || !got.IPOption(OptionRequestedIP).Equal(net.ParseIP("192.168.27.101")) {
+		t.Errorf("unexpected options %v", got.Options)
+	}
+
+	_, err = Parse(m.Bytes()[:100])
+	if err != ErrInvalidMessage {
+		t.Errorf("expected ErrInvalidMessage got %v", err)
+	}
+}
+
+func TestLeases(t *testing.T) {
+	l := newTestLeases(t)
+	now := time.Unix(1760680800, 0)
+	l.now = func() time.Time { return now }
+
+	ip, err := l.Offer(clientMAC, net.ParseIP("192.168.27.101"), "pixel-7")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ip.Equal(net.ParseIP("192.168.27.101")) {
+		t.Errorf("expected requested address got %s", ip)
+	}
+	if len(l.List()) != 0 {
+		t.Errorf("offered addresses should not be listed")
+	}
+
+	other := net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff}
+	ip, err = l.Offer(other, net.ParseIP("192.168.27.101"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ip.Equal(net.ParseIP("192.168.27.100")) {
+		t.Errorf("expected lowest free address got %s", ip)
+	}
+	if _, ok := l.Bind(other, net.ParseIP("192.168.27.101"), ""); ok {
+		t.Errorf("should not bind an address offered to someone else")
+	}
+
+	lease, ok := l.Bind(clientMAC, net.ParseIP("192.168.27.101"), "")
+	if !ok || lease.Hostname != "pixel-7" || !lease.Expiry.Equal(now.Add(time.Hour)) {
+		t.Fatalf("unexpected lease %+v %t", lease, ok)
+	}
+	if _, ok := l.Bind(clientMAC, net.ParseIP("10.0.0.1"), ""); ok {
+		t.Errorf("should not bind an address outside the range")
+	}
+
+	list := l.List()
+	if len(list) != 1 || !list[0].IP.Equal(net.ParseIP("192.168.27.101")) {
+		t.Errorf("expected bound lease to be listed got %+v", list)
+	}
+
+	_, err = l.Offer(net.HardwareAddr{1, 2, 3, 4, 5, 6}, nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = l.Offer(net.HardwareAddr{1, 2, 3, 4, 5, 7}, nil, "")
+	if err != ErrNoFreeAddress {
+		t.Errorf("expected ErrNoFreeAddress got %v", err)
+	}
+
+	now = now.Add(2 * offerTimeout) // the offers expire
+	_, err = l.Offer(net.HardwareAddr{1, 2, 3, 4, 5, 7}, nil, "")
+	if err != nil {
+		t.Errorf("expected expired offer to be reused got %v", err)
+	}
+
+	l.Release(clientMAC)
+	if len(l.List()) != 0 {
+		t.Errorf("expected released lease to be removed")
+	}
+}
+
+// TestServe runs DISCOVER, OFFER, REQUEST and ACK over loopback.
+func TestServe(t *testing.T) {
+	serverConn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientConn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clientConn.Close()
+
+	s := NewServer("", net.ParseIP("192.168.27.1"), newTestLeases(t))
+	s.broadcast = clientConn.LocalAddr().(*net.UDPAddr)
+	s.Options[OptionCaptivePortal] = []byte("http://192.168.27.1/")
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- s.Serve(ctx, serverConn) }()
+
+	exchange := func(req *Message) *Message {
+		_, err := clientConn.WriteTo(req.Bytes(), serverConn.LocalAddr())
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = clientConn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 1500)
+		n, _, err := clientConn.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reply, err := Parse(buf[:n])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return reply
+	}
+	request := func(t MessageType, options map[byte][]byte) *Message {
+		options[OptionMessageType] = []byte{byte(t)}
+		return &Message{Op: opRequest, XID: 42, CHAddr: clientMAC, Options: options}
+	}
+
+	offer := exchange(request(Discover, map[byte][]byte{OptionHostname: []byte("pixel-7")}))
+	if offer.Type() != Offer || offer.XID != 42 || !offer.YIAddr.Equal(net.ParseIP("192.168.27.100")) {
+		t.Fatalf("unexpected offer %s %+v", offer.Type(), offer)
+	}
+	if !offer.IPOption(OptionRouter).Equal(net.ParseIP("192.168.27.1")) || !offer.IPOption(OptionDNS).Equal(net.ParseIP("192.168.27.1")) {
+		t.Errorf("expected us as router and DNS got %v", offer.Options)
+	}
+	if string(offer.Options[OptionCaptivePortal]) != "http://192.168.27.1/" {
+		t.Errorf("expected extra option to be sent got %q", offer.Options[OptionCaptivePortal])
+	}
+
+	ack := exchange(request(Request, map[byte][]byte{
+		OptionRequestedIP:      offer.YIAddr,
+		OptionServerIdentifier: net.ParseIP("192.168.27.1").To4(),
+	}))
+	if ack.Type() != Ack || !ack.YIAddr.Equal(offer.YIAddr) || len(ack.Options[OptionLeaseTime]) != 4 {
+		t.Fatalf("unexpected ack %s %+v", ack.Type(), ack)
+	}
+	if list := s.Leases.List(); len(list) != 1 || list[0].Hostname != "pixel-7" {
+		t.Errorf("expected lease to be listed got %+v", list)
+	}
+
+	nak := exchange(request(Request, map[byte][]byte{OptionRequestedIP: net.ParseIP("10.0.0.5").To4()}))
+	if nak.Type() != Nak {
+		t.Errorf("expected NAK for address outside range got %s", nak.Type())
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,162 @@
+package dhcp
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"slices"
+	"sync"
+	"time"
+)
+
+// offerTimeout is how long an offered address is reserved for the client that got it.
+const offerTimeout = time.Minute
+
+var ErrNoFreeAddress = errors.New("no free address in DHCP range")
+
+// Lease is an address handed out to a client.
+type Lease struct {
+	MAC      net.HardwareAddr
+	IP       net.IP
+	Hostname string
+	Expiry   time.Time
+	// Bound is false while the address is only offered.
+	Bound bool
+}
+
+// Leases is the lease table of a Server. It is safe for concurrent use so the status API can list it.
+type Leases struct {
+	start    uint32
+	end      uint32
+	duration time.Duration
+	leases   map[string]*Lease // by MAC
+	now      func() time.Time
+
+	mutex sync.Mutex
+}
+
+// NewLeases hands out addresses from start to end inclusive for duration.
+func NewLeases(start, end net.IP, duration time.Duration) (*Leases, error) {
+	s, e := ipToUint(start), ipToUint(end)
+	if s == 0 || e == 0 || s > e {
+		return nil, errors.New("invalid DHCP range")
+	}
+	return &Leases{
+		start:    s,
+		end:      e,
+		duration: duration,
+		leases:   map[string]*Lease{},
+		now:      time.Now,
+	}, nil
+}
+
+// List returns copies of the bound leases that have not expired, ordered by address.
+func (l *Leases) List() []Lease {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := l.now()
+	list := []Lease{}
+	for _, lease := range l.leases {
+		if lease.Bound && lease.Expiry.After(now) {
+			list = append(list, *lease)
+		}
+	}
+	slices.SortFunc(list, func(a, b Lease) int {
+		return int(int64(ipToUint(a.IP)) - int64(ipToUint(b.IP)))
+	})
+	return list
+}
+
+// Offer reserves an address for mac. The current address of mac is preferred, then requested and then the
+// lowest free address.
+func (l *Leases) Offer(mac net.HardwareAddr, requested net.IP, hostname string) (net.IP, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := l.now()
+	if lease, ok := l.leases[mac.String()]; ok {
+		if !lease.Bound {
+			lease.Expiry = now.Add(offerTimeout)
+		}
+		return lease.IP, nil
+	}
+
+	ip := requested
+	if !l.free(ip, mac, now) {
+		ip = nil
+		for i := l.start; i <= l.end; i++ {
+			if candidate := uintToIP(i); l.free(candidate, mac, now) {
+				ip = candidate
+				break
+			}
+		}
+	}
+	if ip == nil {
+		return nil, ErrNoFreeAddress
+	}
+	l.leases[mac.String()] = &Lease{MAC: mac, IP: ip, Hostname: hostname, Expiry: now.Add(offerTimeout)}
+	return ip, nil
+}
+
+// Bind confirms the lease of ip for mac. It fails if the address is outside our range or used by someone else.
+func (l *Leases) Bind(mac net.HardwareAddr, ip net.IP, hostname string) (*Lease, bool) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := l.now()
+	lease, ok := l.leases[mac.String()]
+	if !ok || !lease.IP.Equal(ip) {
+		if !l.free(ip, mac, now) {
+			return nil, false
+		}
+		lease = &Lease{MAC: mac, IP: ip}
+		l.leases[mac.String()] = lease
+	}
+	if hostname != "" {
+		lease.Hostname = hostname
+	}
+	lease.Bound = true
+	lease.Expiry = now.Add(l.duration)
+	c := *lease
+	return &c, true
+}
+
+// Release removes the lease of mac.
+func (l *Leases) Release(mac net.HardwareAddr) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	delete(l.leases, mac.String())
+}
+
+// free reports if ip is in our range and not leased to anyone but mac.
+func (l *Leases) free(ip net.IP, mac net.HardwareAddr, now time.Time) bool {
+	n := ipToUint(ip)
+	if n < l.start || n > l.end {
+		return false
+	}
+	for key, lease := range l.leases {
+		if !lease.IP.Equal(ip) || key == mac.String() {
+			continue
+		}
+		if lease.Expiry.After(now) {
+			return false
+		}
+		delete(l.leases, key) // expired
+	}
+	return true
+}
+
+func ipToUint(ip net.IP) uint32 {
+	ip = ip.To4()
+	if ip == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint32(ip)
+}
+
+func uintToIP(n uint32) net.IP {
+	ip := make(net.IP, 4)
+	binary.BigEndian.PutUint32(ip, n)
+	return ip
+}
@@ -0,0 +1,183 @@
+package dhcp
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+)
+
+// MessageType is the value of OptionMessageType.
+type MessageType byte
+
+const (
+	Discover MessageType = 1
+	Offer    MessageType = 2
+	Request  MessageType = 3
+	Decline  MessageType = 4
+	Ack      MessageType = 5
+	Nak      MessageType = 6
+	Release  MessageType = 7
+	Inform   MessageType = 8
+)
+
+func (t MessageType) String() string {
+	names := []string{"", "DISCOVER", "OFFER", "REQUEST", "DECLINE", "ACK", "NAK", "RELEASE", "INFORM"}
+	if int(t) < len(names) && t != 0 {
+		return names[t]
+	}
+	return "UNKNOWN"
+}
+
+// Option codes from RFC 2132.
+const (
+	OptionPad              byte = 0
+	OptionSubnetMask       byte = 1
+	OptionRouter           byte = 3
+	OptionDNS              byte = 6
+	OptionHostname         byte = 12
+	OptionRequestedIP      byte = 50
+	OptionLeaseTime        byte = 51
+	OptionMessageType      byte = 53
+	OptionServerIdentifier byte = 54
+	OptionCaptivePortal    byte = 114 // RFC 8910
+	OptionEnd              byte = 255
+)
+
+const (
+	opRequest = 1
+	opReply   = 2
+
+	flagBroadcast = 0x8000
+
+	headerLen = 236
+)
+
+var magicCookie = []byte{99, 130, 83, 99}
+
+var ErrInvalidMessage = errors.New("invalid DHCP message")
+
+// Message is a DHCPv4 message. Only the fields we need are decoded, see RFC 2131.
+type Message struct {
+	Op     byte
+	XID    uint32
+	Flags  uint16
+	CIAddr net.IP
+	YIAddr net.IP
+	SIAddr net.IP
+	GIAddr net.IP
+	CHAddr net.HardwareAddr
+
+	Options map[byte][]byte
+}
+
+// Parse decodes a DHCPv4 message.
+func Parse(b []byte) (*Message, error) {
+	if len(b) < headerLen+len(magicCookie) || string(b[headerLen:headerLen+4]) != string(magicCookie) {
+		return nil, ErrInvalidMessage
+	}
+	hlen := int(b[2])
+	if hlen > 16 {
+		return nil, ErrInvalidMessage
+	}
+	m := &Message{
+		Op:      b[0],
+		XID:     binary.BigEndian.Uint32(b[4:8]),
+		Flags:   binary.BigEndian.Uint16(b[10:12]),
+		CIAddr:  net.IP(b[12:16]).To4(),
+		YIAddr:  net.IP(b[16:20]).To4(),
+		SIAddr:  net.IP(b[20:24]).To4(),
+		GIAddr:  net.IP(b[24:28]).To4(),
+		CHAddr:  net.HardwareAddr(append([]byte{}, b[28:28+hlen]...)),
+		Options: map[byte][]byte{},
+	}
+
+	options := b[headerLen+4:]
+	for i := 0; i < len(options); {
+		code := options[i]
+		switch code {
+		case OptionPad:
+			i++
+			continue
+		case OptionEnd:
+			return m, nil
+		}
+		if i+1 >= len(options) || i+2+int(options[i+1]) > len(options) {
+			return nil, ErrInvalidMessage
+		}
+		length := int(options[i+1])
+		m.Options[code] = append(m.Options[code], options[i+2:i+2+length]...) // RFC 3396 concatenation
+		i += 2 + length
+	}
+	return m, nil
+}
+
+// Bytes encodes the message.
+func (m *Message) Bytes() []byte {
+	b := make([]byte, headerLen, 300)
+	b[0] = m.Op
+	b[1] = 1 // ethernet
+	b[2] = byte(len(m.CHAddr))
+	binary.BigEndian.PutUint32(b[4:8], m.XID)
+	binary.BigEndian.PutUint16(b[10:12], m.Flags)
+	copy(b[12:16], m.CIAddr.To4())
+	copy(b[16:20], m.YIAddr.To4())
+	copy(b[20:24], m.SIAddr.To4())
+	copy(b[24:28], m.GIAddr.To4())
+	copy(b[28:44], m.CHAddr)
+	b = append(b, magicCookie...)
+
+	// message type first, some clients expect it
+	if t, ok := m.Options[OptionMessageType]; ok {
+		b = append(b, OptionMessageType, byte(len(t)))
+		b = append(b, t...)
+	}
+	for code := 1; code < int(OptionEnd); code++ {
+		value, ok := m.Options[byte(code)]
+		if !ok || byte(code) == OptionMessageType {
+			continue
+		}
+		for len(value) > 255 {
+			b = append(b, byte(code), 255)
+			b = append(b, value[:255]...)
+			value = value[255:]
+		}
+		b = append(b, byte(code), byte(len(value)))
+		b = append(b, value...)
+	}
+	b = append(b, OptionEnd)
+	for len(b) < 300 { // minimum BOOTP message size
+		b = append(b, OptionPad)
+	}
+	return b
+}
+
+// Type returns the DHCP message type or 0 if it is missing.
+func (m *Message) Type() MessageType {
+	if t := m.Options[OptionMessageType]; len(t) == 1 {
+		return MessageType(t[0])
+	}
+	return 0
+}
+
+// IPOption returns an option holding a single IPv4 address or nil.
+func (m *Message) IPOption(code byte) net.IP {
+	if v := m.Options[code]; len(v) == 4 {
+		return net.IP(v).To4()
+	}
+	return nil
+}
+
+// reply returns a message answering m with type t.
+func (m *Message) reply(t MessageType) *Message {
+	return &Message{
+		Op:      opReply,
+		XID:     m.XID,
+		Flags:   m.Flags,
+		CIAddr:  net.IPv4zero,
+		YIAddr:  net.IPv4zero,
+		SIAddr:  net.IPv4zero,
+		GIAddr:  m.GIAddr,
+		CHAddr:  m.CHAddr,
+		Options: map[byte][]byte{OptionMessageType: {byte(t)}},
+	}
+}
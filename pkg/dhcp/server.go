@@ -0,0 +1,156 @@
+// Package dhcp is a small DHCPv4 server handing out addresses to the clients of our AP. It only answers
+// directly connected clients, relays are not supported.
+package dhcp
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/nergy-se/wificonfig/pkg/network"
+	"github.com/sirupsen/logrus"
+)
+
+// Server answers DHCP requests on one interface. ServerIP is handed out as router and DNS server.
+type Server struct {
+	Interface string
+	ServerIP  net.IP
+	Mask      net.IPMask
+	Leases    *Leases
+	// Options are added to every OFFER and ACK, for example the captive portal URL.
+	Options map[byte][]byte
+
+	// broadcast is where replies to clients without an address are sent.
+	broadcast *net.UDPAddr
+}
+
+func NewServer(iface string, serverIP net.IP, leases *Leases) *Server {
+	return &Server{
+		Interface: iface,
+		ServerIP:  serverIP.To4(),
+		Mask:      serverIP.DefaultMask(),
+		Leases:    leases,
+		Options:   map[byte][]byte{},
+		broadcast: &net.UDPAddr{IP: net.IPv4bcast, Port: 68},
+	}
+}
+
+// ListenAndServe serves DHCP on port 67 of Interface until ctx is done.
+func (s *Server) ListenAndServe(ctx context.Context) error {
+	conn, err := network.ListenUDP(ctx, s.Interface, ":67")
+	if err != nil {
+		return err
+	}
+	return s.Serve(ctx, conn)
+}
+
+// Serve answers DHCP requests received on conn until ctx is done. conn is closed when Serve returns.
+func (s *Server) Serve(ctx context.Context, conn net.PacketConn) error {
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+
+	buf := make([]byte, 1500)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
+			logrus.Warnf("dhcp: error reading: %s", err)
+			continue
+		}
+
+		req, err := Parse(buf[:n])
+		if err != nil || req.Op != opRequest {
+			continue
+		}
+		reply := s.handle(req)
+		if reply == nil {
+			continue
+		}
+		_, err = conn.WriteTo(reply.Bytes(), s.replyAddr(req))
+		if err != nil {
+			logrus.Warnf("dhcp: error replying to %s: %s", req.CHAddr, err)
+		}
+	}
+}
+
+// replyAddr unicasts to clients that already have an address and broadcasts otherwise since we cannot
+// send to an address the client does not have yet without raw sockets.
+func (s *Server) replyAddr(req *Message) net.Addr {
+	if req.CIAddr != nil && !req.CIAddr.Equal(net.IPv4zero) {
+		return &net.UDPAddr{IP: req.CIAddr, Port: s.broadcast.Port}
+	}
+	return s.broadcast
+}
+
+// handle returns the reply to req or nil if it should not be answered.
+func (s *Server) handle(req *Message) *Message {
+	hostname := string(req.Options[OptionHostname])
+	logrus.Debugf("dhcp: %s from %s %s", req.Type(), req.CHAddr, hostname)
+
+	switch req.Type() {
+	case Discover:
+		ip, err := s.Leases.Offer(req.CHAddr, req.IPOption(OptionRequestedIP), hostname)
+		if err != nil {
+			logrus.Warnf("dhcp: %s: %s", req.CHAddr, err)
+			return nil
+		}
+		reply := req.reply(Offer)
+		reply.YIAddr = ip
+		s.addOptions(reply, true)
+		return reply
+
+	case Request:
+		if id := req.IPOption(OptionServerIdentifier); id != nil && !id.Equal(s.ServerIP) {
+			s.Leases.Release(req.CHAddr) // the client picked another server
+			return nil
+		}
+		ip := req.IPOption(OptionRequestedIP)
+		if ip == nil {
+			ip = req.CIAddr // renewing
+		}
+		lease, ok := s.Leases.Bind(req.CHAddr, ip, hostname)
+		if !ok {
+			logrus.Infof("dhcp: NAK %s for %s", ip, req.CHAddr)
+			reply := req.reply(Nak)
+			reply.Options[OptionServerIdentifier] = s.ServerIP
+			return reply
+		}
+		logrus.Infof("dhcp: leased %s to %s %s", lease.IP, lease.MAC, lease.Hostname)
+		reply := req.reply(Ack)
+		reply.YIAddr = lease.IP
+		s.addOptions(reply, true)
+		return reply
+
+	case Inform:
+		reply := req.reply(Ack)
+		reply.CIAddr = req.CIAddr
+		s.addOptions(reply, false)
+		return reply
+
+	case Release, Decline:
+		s.Leases.Release(req.CHAddr)
+	}
+	return nil
+}
+
+func (s *Server) addOptions(reply *Message, lease bool) {
+	reply.Options[OptionServerIdentifier] = s.ServerIP
+	reply.Options[OptionSubnetMask] = s.Mask
+	reply.Options[OptionRouter] = s.ServerIP
+	reply.Options[OptionDNS] = s.ServerIP
+	if lease {
+		reply.Options[OptionLeaseTime] = binary.BigEndian.AppendUint32(nil, uint32(s.Leases.duration/time.Second))
+	}
+	for code, value := range s.Options {
+		reply.Options[code] = value
+	}
+}
@@ -0,0 +1,141 @@
+// Package dns is a wildcard DNS responder answering every A query with the same address so clients of our AP
+// end up on the portal whatever name they look up.
+package dns
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+
+	"github.com/nergy-se/wificonfig/pkg/network"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	typeA   = 1
+	classIN = 1
+
+	rcodeFormatError    = 1
+	rcodeNotImplemented = 4
+
+	headerLen = 12
+)
+
+var errInvalidQuery = errors.New("invalid DNS query")
+
+// Server answers A queries for all names with IP. Other query types get an empty answer.
+type Server struct {
+	Interface string
+	IP        net.IP
+}
+
+func NewServer(iface string, ip net.IP) *Server {
+	return &Server{Interface: iface, IP: ip.To4()}
+}
+
+// ListenAndServe serves DNS on port 53 of Interface until ctx is done.
+func (s *Server) ListenAndServe(ctx context.Context) error {
+	conn, err := network.ListenUDP(ctx, s.Interface, ":53")
+	if err != nil {
+		return err
+	}
+	return s.Serve(ctx, conn)
+}
+
+// Serve answers queries received on conn until ctx is done. conn is closed when Serve returns.
+func (s *Server) Serve(ctx context.Context, conn net.PacketConn) error {
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+
+	buf := make([]byte, 512)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
+			logrus.Warnf("dns: error reading: %s", err)
+			continue
+		}
+
+		reply, err := s.answer(buf[:n])
+		if err != nil {
+			logrus.Debugf("dns: %s from %s", err, addr)
+			continue
+		}
+		_, err = conn.WriteTo(reply, addr)
+		if err != nil {
+			logrus.Debugf("dns: error replying to %s: %s", addr, err)
+		}
+	}
+}
+
+// answer returns the response to query.
+func (s *Server) answer(query []byte) ([]byte, error) {
+	if len(query) < headerLen || query[2]&0x80 != 0 { // too short or a response
+		return nil, errInvalidQuery
+	}
+
+	flags := binary.BigEndian.Uint16(query[2:4])
+	opcode := (flags >> 11) & 0xF
+	qdcount := binary.BigEndian.Uint16(query[4:6])
+
+	end, qtype, qclass, err := parseQuestion(query)
+	rcode := uint16(0)
+	switch {
+	case opcode != 0:
+		rcode = rcodeNotImplemented
+	case qdcount != 1 || err != nil:
+		rcode = rcodeFormatError
+	}
+
+	reply := make([]byte, headerLen, 512)
+	copy(reply, query[:2]) // id
+	// QR, opcode, AA, RD from the query
+	binary.BigEndian.PutUint16(reply[2:4], 0x8000|flags&0x7900|0x0400|rcode)
+	if rcode != 0 {
+		return reply, nil
+	}
+	binary.BigEndian.PutUint16(reply[4:6], 1)
+	reply = append(reply, query[headerLen:end]...)
+
+	if qtype == typeA && qclass == classIN {
+		binary.BigEndian.PutUint16(reply[6:8], 1)
+		reply = append(reply, 0xC0, headerLen) // pointer to the name in the question
+		reply = binary.BigEndian.AppendUint16(reply, typeA)
+		reply = binary.BigEndian.AppendUint16(reply, classIN)
+		reply = binary.BigEndian.AppendUint32(reply, 0) // ttl, do not cache
+		reply = binary.BigEndian.AppendUint16(reply, 4)
+		reply = append(reply, s.IP...)
+	}
+	return reply, nil
+}
+
+// parseQuestion returns the end offset, type and class of the first question.
+func parseQuestion(query []byte) (int, uint16, uint16, error) {
+	i := headerLen
+	for {
+		if i >= len(query) {
+			return 0, 0, 0, errInvalidQuery
+		}
+		length := int(query[i])
+		if length == 0 {
+			i++
+			break
+		}
+		if length&0xC0 != 0 { // no compression in questions
+			return 0, 0, 0, errInvalidQuery
+		}
+		i += 1 + length
+	}
+	if i+4 > len(query) {
+		return 0, 0, 0, errInvalidQuery
+	}
+	return i + 4, binary.BigEndian.Uint16(query[i : i+2]), binary.BigEndian.Uint16(query[i+2 : i+4]), nil
+}
@@ -0,0 +1,91 @@
+package dns
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+// query for name with type qtype and id 0x1234 with recursion desired.
+func query(name string, qtype uint16) []byte {
+	q := []byte{0x12, 0x34, 0x01, 0x00, 0, 1, 0, 0, 0, 0, 0, 0}
+	for _, label := range bytes.Split([]byte(name), []byte(".")) {
+		q = append(q, byte(len(label)))
+		q = append(q, label...)
+	}
+	return append(q, 0, byte(qtype>>8), byte(qtype), 0, 1)
+}
+
+func TestAnswer(t *testing.T) {
+	s := NewServer("", net.ParseIP("192.168.27.1"))
+
+	q := query("connectivitycheck.gstatic.com", typeA)
+	reply, err := s.answer(q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(reply[:2], q[:2]) || reply[2] != 0x85 || reply[3] != 0x00 {
+		t.Errorf("unexpected header % x", reply[:4])
+	}
+	if !bytes.Equal(reply[4:8], []byte{0, 1, 0, 1}) {
+		t.Errorf("expected one question and one answer got % x", reply[4:8])
+	}
+	if !bytes.Equal(reply[len(reply)-4:], []byte{192, 168, 27, 1}) {
+		t.Errorf("expected answer with our address got % x", reply[len(reply)-4:])
+	}
+
+	reply, err = s.answer(query("captive.apple.com", 28)) // AAAA
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply[3]&0xF != 0 || !bytes.Equal(reply[6:8], []byte{0, 0}) {
+		t.Errorf("expected empty answer for AAAA got % x", reply)
+	}
+
+	reply, err = s.answer(q[:20])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply[3]&0xF != rcodeFormatError {
+		t.Errorf("expected format error for truncated query got % x", reply)
+	}
+
+	_, err = s.answer(reply)
+	if err == nil {
+		t.Error("expected responses to be ignored")
+	}
+}
+
+func TestServe(t *testing.T) {
+	serverConn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewServer("", net.ParseIP("192.168.27.1"))
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- s.Serve(ctx, serverConn) }()
+
+	r := &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			return net.Dial("udp4", serverConn.LocalAddr().String())
+		},
+	}
+	lookupCtx, lookupCancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer lookupCancel()
+	ips, err := r.LookupIP(lookupCtx, "ip4", "www.msftconnecttest.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ips) != 1 || !ips[0].Equal(net.ParseIP("192.168.27.1")) {
+		t.Errorf("expected 192.168.27.1 got %v", ips)
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Error(err)
+	}
+}
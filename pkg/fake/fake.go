@@ -0,0 +1,173 @@
+// Package fake has fake implementations of the wifi, AP, DHCP, connectivity and network config dependencies
+// of App so it can be tested without a device.
+package fake
+
+import (
+	"context"
+	"net"
+
+	"github.com/nergy-se/wificonfig/pkg/wpa"
+)
+
+type Wifi struct {
+	Running              bool
+	Connected            bool
+	AP                   bool
+	Channel              int
+	StationChannelResult int
+	PSK                  string
+	StartErr             error
+	StatusErr            error
+
+	Calls []string
+}
+
+func (w *Wifi) StartWpaSupplicant(ctx context.Context) error {
+	w.Calls = append(w.Calls, "StartWpaSupplicant")
+	if w.StartErr != nil {
+		return w.StartErr
+	}
+	w.Running = true
+	return nil
+}
+
+func (w *Wifi) StopWpaSupplicant() error {
+	w.Calls = append(w.Calls, "StopWpaSupplicant")
+	w.Running = false
+	return nil
+}
+
+func (w *Wifi) WpaRunning() bool {
+	return w.Running
+}
+
+func (w *Wifi) WpaConnectedToWifi() (bool, error) {
+	return w.Connected, w.StatusErr
+}
+
+func (w *Wifi) WpaIsAp() (bool, error) {
+	return w.AP, w.StatusErr
+}
+
+func (w *Wifi) WatchWpaEvents(ctx context.Context, fn func(*wpa.Event)) {
+	<-ctx.Done()
+}
+
+func (w *Wifi) SelectAPChannel() (int, error) {
+	w.Calls = append(w.Calls, "SelectAPChannel")
+	return w.Channel, nil
+}
+
+func (w *Wifi) StationChannel() (int, error) {
+	return w.StationChannelResult, w.StatusErr
+}
+
+func (w *Wifi) SetAPPSK(psk string) error {
+	w.Calls = append(w.Calls, "SetAPPSK")
+	w.PSK = psk
+	return nil
+}
+
+type AP struct {
+	Running bool
+	Up      bool
+	Channel int
+	PSK     string
+	Err     error
+
+	Calls []string
+}
+
+func (a *AP) Start(ctx context.Context) error {
+	a.Calls = append(a.Calls, "Start")
+	if a.Err != nil {
+		return a.Err
+	}
+	a.Running = true
+	return nil
+}
+
+func (a *AP) Stop() error {
+	a.Calls = append(a.Calls, "Stop")
+	a.Running = false
+	return nil
+}
+
+func (a *AP) IsUp() (bool, error) {
+	return a.Running && a.Up, a.Err
+}
+
+func (a *AP) SetChannel(channel int) {
+	a.Channel = channel
+}
+
+func (a *AP) SetPSK(psk string) {
+	a.PSK = psk
+}
+
+func (a *AP) WatchWpaEvents(ctx context.Context, fn func(*wpa.Event)) {
+	<-ctx.Done()
+}
+
+type DHCP struct {
+	Running  bool
+	StartErr error
+
+	Calls []string
+}
+
+func (d *DHCP) Start(ctx context.Context) error {
+	d.Calls = append(d.Calls, "Start")
+	if d.StartErr != nil {
+		return d.StartErr
+	}
+	d.Running = true
+	return nil
+}
+
+func (d *DHCP) Stop() error {
+	d.Calls = append(d.Calls, "Stop")
+	d.Running = false
+	return nil
+}
+
+type Prober struct {
+	AliveResult      bool
+	AliveErr         error
+	Active           string
+	ActiveErr        error
+	InterfaceWithIPs map[string]string // ip -> interface name
+}
+
+func (p *Prober) Alive() (bool, error) {
+	return p.AliveResult, p.AliveErr
+}
+
+func (p *Prober) ActiveInterface() (string, error) {
+	return p.Active, p.ActiveErr
+}
+
+func (p *Prober) InterfaceWithIP(ip net.IP) (string, error) {
+	return p.InterfaceWithIPs[ip.String()], nil
+}
+
+type Network struct {
+	SyncErr error
+	Err     error
+
+	Calls []string
+}
+
+func (n *Network) SyncStaticConfig() error {
+	return n.SyncErr
+}
+
+func (n *Network) Reconfigure(iface string) error {
+	n.Calls = append(n.Calls, "Reconfigure "+iface)
+	return n.Err
+}
+
+func (n *Network) SetAddress(iface, ip string) error {
+	n.Calls = append(n.Calls, "SetAddress "+iface+" "+ip)
+	return n.Err
+}
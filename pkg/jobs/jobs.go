@@ -0,0 +1,228 @@
+package jobs
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+type Phase string
+
+const (
+	PhaseQueued         Phase = "queued"
+	PhaseAssociating    Phase = "associating"
+	PhaseAuthenticating Phase = "authenticating"
+	PhaseObtainingDHCP  Phase = "obtaining DHCP"
+	PhaseVerifying      Phase = "verifying alive-url"
+	PhaseDone           Phase = "done"
+	PhaseFailed         Phase = "failed"
+	PhaseCancelled      Phase = "cancelled"
+)
+
+// maxJobs is how many jobs we keep and persist.
+const maxJobs = 10
+
+var ErrRunning = errors.New("a connection attempt is already running")
+
+// Job is an asynchronous attempt to connect to a network.
+type Job struct {
+	ID      string    `json:"id"`
+	SSID    string    `json:"ssid"`
+	Phase   Phase     `json:"phase"`
+	Error   string    `json:"error,omitempty"`
+	Created time.Time `json:"created"`
+	Updated time.Time `json:"updated"`
+}
+
+func (j *Job) Finished() bool {
+	return j.Phase == PhaseDone || j.Phase == PhaseFailed || j.Phase == PhaseCancelled
+}
+
+// Store keeps track of jobs and persists them to file so the outcome of a connection attempt
+// can be shown after the user reconnects to the portal.
+type Store struct {
+	file string
+	jobs map[string]*Job
+
+	mutex sync.Mutex
+}
+
+func NewStore(file string) *Store {
+	return &Store{
+		file: file,
+		jobs: make(map[string]*Job),
+	}
+}
+
+// New creates a job unless another one is still running.
+func (s *Store) New(ssid string) (Job, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.running() {
+		return Job{}, ErrRunning
+	}
+
+	id := make([]byte, 8)
+	_, err := rand.Read(id)
+	if err != nil {
+		return Job{}, err
+	}
+
+	now := time.Now()
+	j := &Job{
+		ID:      hex.EncodeToString(id),
+		SSID:    ssid,
+		Phase:   PhaseQueued,
+		Created: now,
+		Updated: now,
+	}
+	s.jobs[j.ID] = j
+	s.prune()
+	return *j, nil
+}
+
+// Running reports if a job has not finished yet.
+func (s *Store) Running() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.running()
+}
+
+func (s *Store) running() bool {
+	for _, j := range s.jobs {
+		if !j.Finished() {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Store) SetPhase(id string, phase Phase) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if j, ok := s.jobs[id]; ok && !j.Finished() {
+		j.Phase = phase
+		j.Updated = time.Now()
+	}
+}
+
+// Finish marks the job as done, failed or cancelled depending on err and persists all jobs.
+func (s *Store) Finish(id string, err error) error {
+	s.mutex.Lock()
+	j, ok := s.jobs[id]
+	if ok {
+		switch {
+		case err == nil:
+			j.Phase = PhaseDone
+		case errors.Is(err, context.Canceled):
+			j.Phase = PhaseCancelled
+		default:
+			j.Phase = PhaseFailed
+			j.Error = err.Error()
+		}
+		j.Updated = time.Now()
+	}
+	s.mutex.Unlock()
+
+	return s.save()
+}
+
+func (s *Store) Get(id string) (Job, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	j, ok := s.jobs[id]
+	if !ok {
+		return Job{}, false
+	}
+	return *j, true
+}
+
+// Last returns the most recently created job.
+func (s *Store) Last() (Job, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	sorted := s.sorted()
+	if len(sorted) == 0 {
+		return Job{}, false
+	}
+	return *sorted[len(sorted)-1], true
+}
+
+func (s *Store) sorted() []*Job {
+	sorted := make([]*Job, 0, len(s.jobs))
+	for _, j := range s.jobs {
+		sorted = append(sorted, j)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Created.Before(sorted[j].Created)
+	})
+	return sorted
+}
+
+func (s *Store) prune() {
+	sorted := s.sorted()
+	for len(sorted) > maxJobs {
+		delete(s.jobs, sorted[0].ID)
+		sorted = sorted[1:]
+	}
+}
+
+func (s *Store) save() error {
+	s.mutex.Lock()
+	finished := []*Job{}
+	for _, j := range s.sorted() {
+		if j.Finished() {
+			finished = append(finished, j)
+		}
+	}
+	data, err := json.Marshal(finished)
+	s.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(s.file), 0755)
+	if err != nil {
+		return err
+	}
+	tmp := s.file + ".tmp"
+	err = os.WriteFile(tmp, data, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.file)
+}
+
+// Load restores persisted jobs.
+func (s *Store) Load() error {
+	data, err := os.ReadFile(s.file)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+
+	loaded := []*Job{}
+	err = json.Unmarshal(data, &loaded)
+	if err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, j := range loaded {
+		s.jobs[j.ID] = j
+	}
+	s.prune()
+	return nil
+}
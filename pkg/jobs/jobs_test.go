@@ -0,0 +1,79 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func TestStore(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "jobs.json")
+	s := NewStore(fn)
+
+	job, err := s.New("house")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = s.New("iot")
+	if !errors.Is(err, ErrRunning) {
+		t.Errorf("expected ErrRunning got %v", err)
+	}
+	if !s.Running() {
+		t.Errorf("expected a running job")
+	}
+
+	s.SetPhase(job.ID, PhaseAuthenticating)
+	if j, _ := s.Get(job.ID); j.Phase != PhaseAuthenticating {
+		t.Errorf("expected %s got %s", PhaseAuthenticating, j.Phase)
+	}
+
+	err = s.Finish(job.ID, errors.New("wrong password"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.SetPhase(job.ID, PhaseObtainingDHCP) // finished jobs are not changed
+	if s.Running() {
+		t.Errorf("expected no running job after finish")
+	}
+
+	loaded := NewStore(fn)
+	err = loaded.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	last, ok := loaded.Last()
+	if !ok {
+		t.Fatal("expected persisted job")
+	}
+	if last.ID != job.ID || last.Phase != PhaseFailed || last.Error != "wrong password" {
+		t.Errorf("unexpected job: %+v", last)
+	}
+
+	_, err = loaded.New("iot")
+	if err != nil {
+		t.Errorf("expected new job after the last one finished got %s", err)
+	}
+}
+
+func TestStoreCancelled(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "jobs.json")
+	s := NewStore(fn)
+
+	cancelled, err := s.New("house")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.Finish(cancelled.ID, context.Canceled)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if j, _ := s.Get(cancelled.ID); j.Phase != PhaseCancelled || j.Error != "" {
+		t.Errorf("expected cancelled job got %+v", j)
+	}
+
+	if s.Running() {
+		t.Error("expected no running job after cancel")
+	}
+}
@@ -0,0 +1,138 @@
+package netmon
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"syscall"
+)
+
+const (
+	iffLowerUp = 0x10000
+
+	rtmgrpLink       = 0x1
+	rtmgrpIPv4IfAddr = 0x10
+	rtmgrpIPv6IfAddr = 0x100
+)
+
+func (m *Monitor) subscribe(ctx context.Context, changes chan<- string) error {
+	defer close(changes)
+
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.NETLINK_ROUTE)
+	if err != nil {
+		return fmt.Errorf("netlink socket: %w", err)
+	}
+	defer syscall.Close(fd)
+
+	addr := &syscall.SockaddrNetlink{
+		Family: syscall.AF_NETLINK,
+		Groups: rtmgrpLink | rtmgrpIPv4IfAddr | rtmgrpIPv6IfAddr,
+	}
+	err = syscall.Bind(fd, addr)
+	if err != nil {
+		return fmt.Errorf("netlink bind: %w", err)
+	}
+
+	// wake up every second to check if ctx is done.
+	tv := syscall.Timeval{Sec: 1}
+	err = syscall.SetsockoptTimeval(fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &tv)
+	if err != nil {
+		return err
+	}
+
+	m.initCarrier()
+
+	buf := make([]byte, 65536)
+	for {
+		if ctx.Err() != nil {
+			return nil
+		}
+		n, _, err := syscall.Recvfrom(fd, buf, 0)
+		if errors.Is(err, syscall.EAGAIN) || errors.Is(err, syscall.EINTR) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("netlink recv: %w", err)
+		}
+
+		msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+		if err != nil {
+			return fmt.Errorf("netlink parse: %w", err)
+		}
+		for _, msg := range msgs {
+			reason := m.handleMessage(&msg)
+			if reason == "" {
+				continue
+			}
+			select {
+			case changes <- reason:
+			case <-ctx.Done():
+				return nil
+			}
+		}
+	}
+}
+
+func (m *Monitor) initCarrier() {
+	iface, err := net.InterfaceByName(m.EthernetInterfaceName)
+	if err != nil {
+		return
+	}
+	m.linkChanged(iface.Name, iface.Flags&net.FlagRunning != 0)
+}
+
+// handleMessage returns a reason if msg is a change we should act on.
+func (m *Monitor) handleMessage(msg *syscall.NetlinkMessage) string {
+	switch msg.Header.Type {
+	case syscall.RTM_NEWLINK, syscall.RTM_DELLINK:
+		if len(msg.Data) < syscall.SizeofIfInfomsg {
+			return ""
+		}
+		flags := binary.NativeEndian.Uint32(msg.Data[8:12])
+		name := attrString(msg, syscall.IFLA_IFNAME)
+		carrier := msg.Header.Type == syscall.RTM_NEWLINK && flags&iffLowerUp != 0
+		if m.linkChanged(name, carrier) {
+			if carrier {
+				return name + " carrier up"
+			}
+			return name + " carrier down"
+		}
+
+	case syscall.RTM_NEWADDR, syscall.RTM_DELADDR:
+		if len(msg.Data) < syscall.SizeofIfAddrmsg {
+			return ""
+		}
+		name := attrString(msg, syscall.IFA_LABEL)
+		if name == "" {
+			index := binary.NativeEndian.Uint32(msg.Data[4:8])
+			iface, err := net.InterfaceByIndex(int(index))
+			if err != nil {
+				return ""
+			}
+			name = iface.Name
+		}
+		if m.addrChanged(name) {
+			if msg.Header.Type == syscall.RTM_NEWADDR {
+				return name + " address added"
+			}
+			return name + " address removed"
+		}
+	}
+	return ""
+}
+
+func attrString(msg *syscall.NetlinkMessage, attrType uint16) string {
+	attrs, err := syscall.ParseNetlinkRouteAttr(msg)
+	if err != nil {
+		return ""
+	}
+	for _, attr := range attrs {
+		if attr.Attr.Type == attrType {
+			return strings.TrimRight(string(attr.Value), "\x00")
+		}
+	}
+	return ""
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package netmon
+
+import (
+	"context"
+	"fmt"
+)
+
+func (m *Monitor) subscribe(ctx context.Context, changes chan<- string) error {
+	close(changes)
+	return fmt.Errorf("netlink monitoring is only supported on linux")
+}
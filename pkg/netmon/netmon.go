@@ -0,0 +1,80 @@
+package netmon
+
+import (
+	"context"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Monitor watches rtnetlink for carrier changes on the ethernet interface and address
+// changes on the ethernet and wifi interfaces.
+type Monitor struct {
+	EthernetInterfaceName string
+	WifiInterfaceName     string
+	Debounce              time.Duration
+
+	carrier map[string]bool
+}
+
+func New(ethernetInterfaceName, wifiInterfaceName string, debounce time.Duration) *Monitor {
+	return &Monitor{
+		EthernetInterfaceName: ethernetInterfaceName,
+		WifiInterfaceName:     wifiInterfaceName,
+		Debounce:              debounce,
+		carrier:               make(map[string]bool),
+	}
+}
+
+// Run calls fn with the reason of the last change once no further changes have been seen for m.Debounce.
+// It blocks until ctx is done.
+func (m *Monitor) Run(ctx context.Context, fn func(reason string)) error {
+	changes := make(chan string, 16)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- m.subscribe(ctx, changes)
+	}()
+
+	debounce(ctx, changes, m.Debounce, fn)
+	return <-errCh
+}
+
+// linkChanged is called for every link message and reports if the carrier of an interface we care about changed.
+func (m *Monitor) linkChanged(name string, carrier bool) bool {
+	if name != m.EthernetInterfaceName {
+		return false
+	}
+	old := m.carrier[name]
+	m.carrier[name] = carrier
+	if old == carrier {
+		return false
+	}
+	logrus.Debugf("netmon: %s carrier: %t", name, carrier)
+	return true
+}
+
+func (m *Monitor) addrChanged(name string) bool {
+	return name == m.EthernetInterfaceName || name == m.WifiInterfaceName
+}
+
+func debounce(ctx context.Context, in <-chan string, d time.Duration, fn func(string)) {
+	timer := time.NewTimer(d)
+	timer.Stop()
+	last := ""
+	for {
+		select {
+		case reason, ok := <-in:
+			if !ok {
+				timer.Stop()
+				return
+			}
+			last = reason
+			timer.Reset(d)
+		case <-timer.C:
+			fn(last)
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		}
+	}
+}
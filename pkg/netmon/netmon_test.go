@@ -0,0 +1,60 @@
+package netmon
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestDebounce(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	in := make(chan string)
+	calls := make(chan string, 10)
+	go debounce(ctx, in, 50*time.Millisecond, func(reason string) {
+		calls <- reason
+	})
+
+	// flapping cable
+	for _, r := range []string{"end0 carrier up", "end0 carrier down", "end0 carrier up"} {
+		in <- r
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	select {
+	case reason := <-calls:
+		if reason != "end0 carrier up" {
+			t.Errorf("expected last reason got %s", reason)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("debounced function was never called")
+	}
+
+	select {
+	case reason := <-calls:
+		t.Errorf("expected only one call got another: %s", reason)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestLinkChanged(t *testing.T) {
+	m := New("end0", "wlan0", time.Second)
+
+	tests := []struct {
+		name     string
+		carrier  bool
+		expected bool
+	}{
+		{"wlan0", true, false},
+		{"end0", false, false},
+		{"end0", true, true},
+		{"end0", true, false},
+		{"end0", false, true},
+	}
+	for _, tt := range tests {
+		if got := m.linkChanged(tt.name, tt.carrier); got != tt.expected {
+			t.Errorf("linkChanged(%s, %t) = %t expected %t", tt.name, tt.carrier, got, tt.expected)
+		}
+	}
+}
@@ -0,0 +1,22 @@
+package network
+
+import (
+	"fmt"
+	"path/filepath"
+)
+
+// DetectWifiInterface returns the first interface which has a wireless directory in sysfs.
+func DetectWifiInterface() (string, error) {
+	return detectWifiInterface("/sys/class/net")
+}
+
+func detectWifiInterface(root string) (string, error) {
+	matches, err := filepath.Glob(filepath.Join(root, "*", "wireless"))
+	if err != nil {
+		return "", err
+	}
+	if len(matches) == 0 {
+		return "", fmt.Errorf("found no wireless interface in %s", root)
+	}
+	return filepath.Base(filepath.Dir(matches[0])), nil
+}
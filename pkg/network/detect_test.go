@@ -0,0 +1,30 @@
+package network
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDetectWifiInterface(t *testing.T) {
+	root := t.TempDir()
+	for _, dir := range []string{"end0", "lo", "wlp1s0/wireless", "wlx00c0ca000000/wireless"} {
+		err := os.MkdirAll(filepath.Join(root, dir), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	name, err := detectWifiInterface(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name != "wlp1s0" {
+		t.Errorf("expected wlp1s0 got %s", name)
+	}
+
+	_, err = detectWifiInterface(t.TempDir())
+	if err == nil {
+		t.Error("expected error when there is no wireless interface")
+	}
+}
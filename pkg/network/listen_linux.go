@@ -0,0 +1,33 @@
+package network
+
+import (
+	"context"
+	"net"
+	"syscall"
+)
+
+// ListenUDP listens on addr and only receives packets from iface if it is not empty. Broadcasts are allowed so
+// DHCP replies can reach clients that do not have an address yet.
+func ListenUDP(ctx context.Context, iface, addr string) (net.PacketConn, error) {
+	lc := net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			var err error
+			cerr := c.Control(func(fd uintptr) {
+				err = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1)
+				if err != nil {
+					return
+				}
+				err = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_BROADCAST, 1)
+				if err != nil || iface == "" {
+					return
+				}
+				err = syscall.BindToDevice(int(fd), iface)
+			})
+			if cerr != nil {
+				return cerr
+			}
+			return err
+		},
+	}
+	return lc.ListenPacket(ctx, "udp4", addr)
+}
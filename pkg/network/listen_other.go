@@ -0,0 +1,18 @@
+//go:build !linux
+
+package network
+
+import (
+	"context"
+	"fmt"
+	"net"
+)
+
+// ListenUDP listens on addr. Binding to an interface is only supported on linux.
+func ListenUDP(ctx context.Context, iface, addr string) (net.PacketConn, error) {
+	if iface != "" {
+		return nil, fmt.Errorf("binding to an interface is only supported on linux")
+	}
+	var lc net.ListenConfig
+	return lc.ListenPacket(ctx, "udp4", addr)
+}
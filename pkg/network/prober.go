@@ -0,0 +1,100 @@
+package network
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+)
+
+// Prober checks internet connectivity and which interface the traffic goes through.
+type Prober struct {
+	aliveURL string
+	client   *http.Client
+}
+
+func NewProber(aliveURL string) *Prober {
+	return &Prober{
+		aliveURL: aliveURL,
+		client: &http.Client{
+			Timeout: time.Second * 10,
+		},
+	}
+}
+
+// HasAliveURL reports if we have an alive-url to check.
+func (p *Prober) HasAliveURL() bool {
+	return p.aliveURL != ""
+}
+
+func (p *Prober) Alive() (bool, error) {
+	r, err := p.client.Get(p.aliveURL)
+	if err != nil {
+		return false, err
+	}
+	defer r.Body.Close()
+
+	return r.StatusCode == 200, nil
+}
+
+// ActiveInterface returns the name of the interface used for outbound traffic or "" if there is no route.
+func (p *Prober) ActiveInterface() (string, error) {
+	i, _, err := GetActiveInterface()
+	if err != nil || i == nil {
+		return "", err
+	}
+	return i.Name, nil
+}
+
+// InterfaceWithIP returns the name of the interface having ip or "" if no interface has it.
+func (p *Prober) InterfaceWithIP(ip net.IP) (string, error) {
+	i, _, err := InterfaceHasIP(ip)
+	if err != nil || i == nil {
+		return "", nil
+	}
+	return i.Name, nil
+}
+
+func GetActiveInterface() (*net.Interface, net.IP, error) {
+	outboundIP, err := GetOutboundIP()
+	if err != nil {
+		return nil, nil, nil // we ignore if we get for example connect: network is unreachable
+	}
+	return InterfaceHasIP(outboundIP)
+}
+
+func InterfaceHasIP(expectedIP net.IP) (*net.Interface, net.IP, error) {
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, i := range interfaces {
+		addrs, err := i.Addrs()
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, a := range addrs {
+			ip, _, err := net.ParseCIDR(a.String())
+			if err != nil {
+				return nil, nil, err
+			}
+			if ip.Equal(expectedIP) {
+				return &i, ip, nil
+			}
+		}
+	}
+	return nil, nil, fmt.Errorf("found no interface")
+
+}
+
+func GetOutboundIP() (net.IP, error) {
+	conn, err := net.Dial("udp", "8.8.8.8:80")
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	localAddr := conn.LocalAddr().(*net.UDPAddr)
+
+	return localAddr.IP, nil
+}
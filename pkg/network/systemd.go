@@ -0,0 +1,108 @@
+package network
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/nergy-se/wificonfig/pkg/commands"
+)
+
+// Systemd writes network configuration for systemd-networkd.
+type Systemd struct {
+	wiredStaticConfigLocation string
+}
+
+func NewSystemd(wiredStaticConfigLocation string) *Systemd {
+	return &Systemd{
+		wiredStaticConfigLocation: wiredStaticConfigLocation,
+	}
+}
+
+// SyncStaticConfig copies the wired static config to /etc/systemd/network if it differs, or removes it
+// from there if the config has been removed.
+func (s *Systemd) SyncStaticConfig() error {
+	if strings.HasPrefix(s.wiredStaticConfigLocation, "/etc/systemd/network") {
+		return nil // we already have config in correct location no need to sync it to /etc/systemd/network
+	}
+
+	dstFn := filepath.Join("/etc/systemd/network", filepath.Base(s.wiredStaticConfigLocation))
+
+	srcHash, err := hash(s.wiredStaticConfigLocation)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) { // if the config files does not exist we should remove the destination
+			err := os.Remove(dstFn)
+			if err != nil {
+				if errors.Is(err, fs.ErrNotExist) {
+					return nil // file is already removed
+				}
+				return err
+			}
+
+			_, err = commands.Run("networkctl", "reload")
+			return err
+		}
+		return err
+	}
+
+	dstHash, err := hash(dstFn)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	if dstHash == srcHash {
+		return nil // nothing to do files are the same.
+	}
+
+	srcFile, err := os.Open(s.wiredStaticConfigLocation)
+	if err != nil {
+		return err
+	}
+	defer srcFile.Close()
+
+	dstFile, err := os.OpenFile(dstFn, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer dstFile.Close()
+
+	_, err = io.Copy(dstFile, srcFile)
+	if err != nil {
+		return err
+	}
+
+	_, err = commands.Run("networkctl", "reload")
+	return err
+}
+
+// Reconfigure makes systemd-networkd reapply config for iface, for example to get a new DHCP lease.
+func (s *Systemd) Reconfigure(iface string) error {
+	_, err := commands.Run("networkctl", "reconfigure", iface)
+	return err
+}
+
+func (s *Systemd) SetAddress(iface, ip string) error {
+	_, err := commands.Run("ifconfig", iface, ip)
+	return err
+}
+
+func hash(r string) (string, error) {
+	h := sha256.New()
+
+	f, err := os.Open(r)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	sum := hex.EncodeToString(h.Sum(nil))
+	return sum, nil
+}
@@ -0,0 +1,209 @@
+package state
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+)
+
+type State string
+
+const (
+	Unknown        State = "Unknown"
+	EthernetOnline State = "EthernetOnline"
+	WifiConnecting State = "WifiConnecting"
+	WifiOnline     State = "WifiOnline"
+	APFallback     State = "APFallback"
+	Degraded       State = "Degraded"
+)
+
+// Online reports if we are provisioned and reach the internet through ethernet or wifi.
+func (s State) Online() bool {
+	return s == EthernetOnline || s == WifiOnline
+}
+
+const ReasonTimeout = "timeout"
+
+const maxHistory = 50
+
+// Observation is what reconcile found out about the network before deciding what to do.
+type Observation struct {
+	EthernetActive bool // outbound traffic goes through the ethernet interface
+	Alive          bool // alive-url answered 200
+	WifiConnected  bool // wpa_supplicant is connected as a station
+	APActive       bool // wpa_supplicant is running our AP network
+}
+
+type Transition struct {
+	From   State     `json:"from"`
+	To     State     `json:"to"`
+	Reason string    `json:"reason"`
+	Time   time.Time `json:"time"`
+}
+
+type Timeout struct {
+	After time.Duration
+	To    State
+}
+
+type rule struct {
+	to     State
+	from   []State // empty means from any state
+	reason string
+	guard  func(o Observation) bool
+}
+
+// rules are evaluated in order and the first one with a matching guard decides the state.
+var rules = []rule{
+	{
+		to:     EthernetOnline,
+		reason: "ethernet connected and alive",
+		guard:  func(o Observation) bool { return o.EthernetActive && o.Alive },
+	},
+	{
+		to:     WifiOnline,
+		reason: "wifi connected",
+		guard:  func(o Observation) bool { return o.WifiConnected },
+	},
+	{
+		to:     APFallback,
+		reason: "no ethernet or wifi, AP active",
+		guard:  func(o Observation) bool { return o.APActive },
+	},
+	{
+		to:     WifiConnecting,
+		from:   []State{Unknown, EthernetOnline, WifiOnline, APFallback},
+		reason: "waiting for wpa_supplicant",
+		guard:  func(o Observation) bool { return true },
+	},
+}
+
+func (r rule) allowedFrom(s State) bool {
+	return len(r.from) == 0 || slices.Contains(r.from, s)
+}
+
+type Machine struct {
+	Timeouts map[State]Timeout
+
+	state   State
+	since   time.Time
+	history []Transition
+	now     func() time.Time
+
+	mutex sync.Mutex
+}
+
+// New creates a state machine which gives up on wpa_supplicant after connectTimeout
+// in WifiConnecting and retries again after the same time in Degraded.
+func New(connectTimeout time.Duration) *Machine {
+	return &Machine{
+		Timeouts: map[State]Timeout{
+			WifiConnecting: {After: connectTimeout, To: Degraded},
+			Degraded:       {After: connectTimeout, To: WifiConnecting},
+		},
+		state: Unknown,
+		since: time.Now(),
+		now:   time.Now,
+	}
+}
+
+// Update evaluates o against the transition rules and returns the transition if the state changed.
+func (m *Machine) Update(o Observation) (Transition, bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	now := m.now()
+	for _, r := range rules {
+		if !r.allowedFrom(m.state) || !r.guard(o) {
+			continue
+		}
+		if r.to != m.state {
+			return m.transition(r.to, r.reason, now), true
+		}
+		break
+	}
+
+	if t, ok := m.Timeouts[m.state]; ok && t.After > 0 && now.Sub(m.since) >= t.After {
+		return m.transition(t.To, ReasonTimeout, now), true
+	}
+	return Transition{}, false
+}
+
+func (m *Machine) transition(to State, reason string, now time.Time) Transition {
+	t := Transition{
+		From:   m.state,
+		To:     to,
+		Reason: reason,
+		Time:   now,
+	}
+	m.state = to
+	m.since = now
+	m.history = append(m.history, t)
+	if len(m.history) > maxHistory {
+		m.history = m.history[len(m.history)-maxHistory:]
+	}
+	return t
+}
+
+func (m *Machine) State() (State, time.Time) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.state, m.since
+}
+
+func (m *Machine) History() []Transition {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return slices.Clone(m.history)
+}
+
+type persisted struct {
+	History []Transition `json:"history"`
+}
+
+// Save writes the transition history to fn atomically.
+func (m *Machine) Save(fn string) error {
+	data, err := json.Marshal(persisted{History: m.History()})
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(fn), 0755)
+	if err != nil {
+		return err
+	}
+	tmp := fn + ".tmp"
+	err = os.WriteFile(tmp, data, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, fn)
+}
+
+// Load restores the transition history from fn. The current state is not restored since it
+// must be observed again after a restart.
+func (m *Machine) Load(fn string) error {
+	data, err := os.ReadFile(fn)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+
+	p := &persisted{}
+	err = json.Unmarshal(data, p)
+	if err != nil {
+		return err
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.history = p.History
+	return nil
+}
@@ -0,0 +1,125 @@
+package state
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var (
+	ethernet   = Observation{EthernetActive: true, Alive: true}
+	deadEth    = Observation{EthernetActive: true}
+	wifi       = Observation{WifiConnected: true, Alive: true}
+	ap         = Observation{APActive: true}
+	connecting = Observation{}
+)
+
+type step struct {
+	after    time.Duration // advance the clock before the observation
+	obs      Observation
+	expected State
+	changed  bool
+	reason   string
+}
+
+func TestUpdate(t *testing.T) {
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{
+			name: "ethernet online",
+			steps: []step{
+				{obs: ethernet, expected: EthernetOnline, changed: true},
+				{after: time.Hour, obs: ethernet, expected: EthernetOnline},
+			},
+		},
+		{
+			name: "ethernet without internet falls back to AP",
+			steps: []step{
+				{obs: deadEth, expected: WifiConnecting, changed: true},
+				{after: time.Second, obs: ap, expected: APFallback, changed: true},
+			},
+		},
+		{
+			name: "ethernet unplugged wifi takes over",
+			steps: []step{
+				{obs: ethernet, expected: EthernetOnline, changed: true},
+				{obs: connecting, expected: WifiConnecting, changed: true},
+				{after: 10 * time.Second, obs: wifi, expected: WifiOnline, changed: true},
+			},
+		},
+		{
+			name: "wifi lost becomes AP",
+			steps: []step{
+				{obs: wifi, expected: WifiOnline, changed: true},
+				{obs: ap, expected: APFallback, changed: true},
+				{obs: wifi, expected: WifiOnline, changed: true},
+			},
+		},
+		{
+			name: "stuck connecting times out to degraded and retries",
+			steps: []step{
+				{obs: connecting, expected: WifiConnecting, changed: true},
+				{after: time.Minute, obs: connecting, expected: WifiConnecting},
+				{after: time.Minute, obs: connecting, expected: Degraded, changed: true, reason: ReasonTimeout},
+				{after: time.Minute, obs: connecting, expected: Degraded},
+				{after: time.Minute, obs: connecting, expected: WifiConnecting, changed: true, reason: ReasonTimeout},
+			},
+		},
+		{
+			name: "degraded recovers when AP comes up",
+			steps: []step{
+				{obs: connecting, expected: WifiConnecting, changed: true},
+				{after: 2 * time.Minute, obs: connecting, expected: Degraded, changed: true},
+				{after: time.Second, obs: ap, expected: APFallback, changed: true},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+			m := New(2 * time.Minute)
+			m.now = func() time.Time { return now }
+			m.since = now
+
+			for i, s := range tt.steps {
+				now = now.Add(s.after)
+				tr, changed := m.Update(s.obs)
+				current, _ := m.State()
+				if current != s.expected || changed != s.changed {
+					t.Fatalf("step %d: expected %s (changed %t) got %s (changed %t)", i, s.expected, s.changed, current, changed)
+				}
+				if s.reason != "" && tr.Reason != s.reason {
+					t.Errorf("step %d: expected reason %s got %s", i, s.reason, tr.Reason)
+				}
+			}
+		})
+	}
+}
+
+func TestSaveLoad(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "wificonfig", "state.json")
+
+	m := New(time.Minute)
+	m.Update(wifi)
+	m.Update(ap)
+	err := m.Save(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	loaded := New(time.Minute)
+	err = loaded.Load(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	history := loaded.History()
+	if len(history) != 2 || history[0].To != WifiOnline || history[1].From != WifiOnline || history[1].To != APFallback {
+		t.Errorf("unexpected history: %+v", history)
+	}
+	if current, _ := loaded.State(); current != Unknown {
+		t.Errorf("expected state to be observed again after load got %s", current)
+	}
+}
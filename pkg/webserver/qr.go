@@ -0,0 +1,97 @@
+package webserver
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/nergy-se/wificonfig/pkg/ap"
+	"github.com/skip2/go-qrcode"
+
+	_ "embed"
+)
+
+//go:embed label.html
+var labelHTML string
+
+var labelTemplate = template.Must(template.New("label").Parse(labelHTML))
+
+// apQR renders a QR code for joining our AP. format is png (default), svg or label for a printable page
+// with the ssid and password next to the code. scale is the size of a module in pixels.
+func (ws *Webserver) apQR(c *gin.Context) error {
+	scale := 8
+	if s := c.Query("scale"); s != "" {
+		var err error
+		scale, err = strconv.Atoi(s)
+		if err != nil || scale < 1 || scale > 40 {
+			return fmt.Errorf("scale must be between 1 and 40")
+		}
+	}
+
+	ssid, psk := ws.credentials.SSID(), ws.credentials.PSK()
+	code, err := qrcode.New(ap.WifiQRPayload(ssid, psk), qrcode.Medium)
+	if err != nil {
+		return err
+	}
+
+	c.Header("Cache-Control", "no-store") // the password changes with --ap-random-psk
+	buf := &bytes.Buffer{}
+	switch c.DefaultQuery("format", "png") {
+	case "png":
+		err = code.Write(-scale, buf) // a negative size is pixels per module
+		if err != nil {
+			return err
+		}
+		c.Data(http.StatusOK, "image/png", buf.Bytes())
+	case "svg":
+		err = writeSVG(buf, code, scale)
+		if err != nil {
+			return err
+		}
+		c.Data(http.StatusOK, "image/svg+xml", buf.Bytes())
+	case "label":
+		svg := &bytes.Buffer{}
+		err = writeSVG(svg, code, scale)
+		if err != nil {
+			return err
+		}
+		err = labelTemplate.Execute(buf, struct {
+			SSID string
+			PSK  string
+			QR   template.HTML
+		}{
+			SSID: ssid,
+			PSK:  psk,
+			QR:   template.HTML(svg.String()), // generated by us, not user input
+		})
+		if err != nil {
+			return err
+		}
+		c.Data(http.StatusOK, "text/html; charset=utf-8", buf.Bytes())
+	default:
+		return fmt.Errorf("unknown format %s, valid formats are png, svg and label", c.Query("format"))
+	}
+	return nil
+}
+
+// writeSVG writes code with its quiet zone as SVG where every module is scale pixels. The SVG scales without blurring.
+func writeSVG(w io.Writer, code *qrcode.QRCode, scale int) error {
+	bitmap := code.Bitmap()
+	size := len(bitmap)
+	path := &strings.Builder{}
+	for y, row := range bitmap {
+		for x, dark := range row {
+			if dark {
+				fmt.Fprintf(path, "M%d,%dh1v1h-1z", x, y)
+			}
+		}
+	}
+	_, err := fmt.Fprintf(w, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" shape-rendering="crispEdges"><rect width="100%%" height="100%%" fill="#fff"/><path fill="#000" d="%s"/></svg>`,
+		size*scale, size*scale, size, size, path.String())
+	return err
+}
@@ -7,6 +7,7 @@ import (
 	"net"
 	"net/http"
 	"os"
+	"sync"
 	"time"
 
 	"github.com/fortnoxab/ginprometheus"
@@ -14,6 +15,10 @@ import (
 	"github.com/gin-gonic/gin"
 	"github.com/jonaz/ginlogrus"
 	"github.com/nergy-se/wificonfig/pkg/ap"
+	"github.com/nergy-se/wificonfig/pkg/captive"
+	"github.com/nergy-se/wificonfig/pkg/jobs"
+	"github.com/nergy-se/wificonfig/pkg/network"
+	"github.com/nergy-se/wificonfig/pkg/state"
 	"github.com/sirupsen/logrus"
 
 	_ "embed"
@@ -22,17 +27,41 @@ import (
 //go:embed index.html
 var index []byte
 
+// LeaseLister lists the DHCP leases of the clients on our AP.
+type LeaseLister interface {
+	Leases() ([]*ap.Lease, error)
+}
+
 type Webserver struct {
 	Port                      string
 	ap                        *ap.Ap
+	state                     *state.Machine
+	jobs                      *jobs.Store
+	prober                    *network.Prober
+	credentials               *ap.Credentials
+	leases                    LeaseLister
+	portal                    *captive.Portal
 	wiredStaticConfigLocation string
+	// PortalPort is an extra port serving the same as Port, usually 80 so captive portal probes reach us.
+	PortalPort string
+
+	// ctx is the context passed to Start, connect jobs are cancelled with it.
+	ctx     context.Context
+	running sync.WaitGroup
 }
 
-func New(port string, ap *ap.Ap, wiredStaticConfigLocation string) *Webserver {
+func New(port string, ap *ap.Ap, sm *state.Machine, jobStore *jobs.Store, prober *network.Prober, credentials *ap.Credentials, leases LeaseLister, portal *captive.Portal, wiredStaticConfigLocation string) *Webserver {
 	return &Webserver{
 		Port:                      port,
 		ap:                        ap,
+		state:                     sm,
+		jobs:                      jobStore,
+		prober:                    prober,
+		credentials:               credentials,
+		leases:                    leases,
+		portal:                    portal,
 		wiredStaticConfigLocation: wiredStaticConfigLocation,
+		ctx:                       context.Background(),
 	}
 }
 
@@ -48,16 +77,17 @@ func (ws *Webserver) Init() *gin.Engine {
 		"favicon.ico",
 	}
 	router.Use(ginlogrus.New(logrus.StandardLogger(), logIgnorePaths...), gin.Recovery())
+	router.Use(func(c *gin.Context) { // OS connectivity probes, see captive.Probes
+		if ws.portal.Handle(c.Writer, c.Request) {
+			c.Abort()
+		}
+	})
 
 	router.GET("/", func(c *gin.Context) {
 		c.Writer.Header().Set("location", "/")
 		c.Data(http.StatusOK, "text/html; charset=utf-8", index)
 		c.Status(http.StatusFound)
 	})
-	router.GET("/generate_204", func(c *gin.Context) {
-		c.Writer.Header().Set("location", "/")
-		c.Status(http.StatusFound)
-	})
 	router.GET("/api/scan-v1", err(ws.scan))
 	router.GET("/api/status-v1", err(func(c *gin.Context) error {
 		interfaces, err := net.Interfaces()
@@ -68,6 +98,7 @@ func (ws *Webserver) Init() *gin.Engine {
 		type Interface struct {
 			Name     string   `json:"name"`
 			Ethernet bool     `json:"ethernet"`
+			Wifi     bool     `json:"wifi"`
 			Static   bool     `json:"static"`
 			IPs      []string `json:"ips"`
 		}
@@ -80,7 +111,11 @@ func (ws *Webserver) Init() *gin.Engine {
 				continue // skip loopback
 			}
 
-			iface := &Interface{Name: i.Name, Ethernet: i.Name == ws.ap.EthernetInterfaceName}
+			iface := &Interface{
+				Name:     i.Name,
+				Ethernet: i.Name == ws.ap.EthernetInterfaceName,
+				Wifi:     i.Name == ws.ap.WifiInterfaceName,
+			}
 			if i.Name == ws.ap.EthernetInterfaceName {
 				iface.Ethernet = true
 				_, err := os.Stat(ws.wiredStaticConfigLocation)
@@ -110,11 +145,31 @@ func (ws *Webserver) Init() *gin.Engine {
 		c.JSON(http.StatusOK, gin.H{
 			"ssid":       ssid,
 			"interfaces": list,
+			"apChannel":  ws.ap.APChannel(),
 		})
 		return nil
 	}))
+	router.GET("/api/state-v1", ws.getState)
 	router.POST("/api/connect-v1", err(ws.connect))
+	router.GET("/api/jobs-v1", ws.lastJob)
+	router.GET("/api/jobs-v1/:id", err(ws.getJob))
+	router.GET("/api/networks-v1", err(ws.listNetworks))
+	router.POST("/api/networks-v1", err(ws.addNetwork))
+	router.POST("/api/networks-v1/reorder", err(ws.reorderNetworks))
+	router.PUT("/api/networks-v1/:id", err(ws.updateNetwork))
+	router.DELETE("/api/networks-v1/:id", err(ws.removeNetwork))
 	router.POST("/api/ethernet-v1", err(ws.configureEthernetIP))
+	router.GET("/api/country-v1", ws.getCountry)
+	router.POST("/api/country-v1", err(ws.setCountry))
+	router.GET("/api/ap-qr-v1", err(ws.apQR))
+	router.GET("/api/ap-clients-v1", err(ws.apClients))
+	router.GET(captive.APIPath, gin.WrapF(ws.portal.API))
+
+	router.NoRoute(func(c *gin.Context) {
+		if !ws.portal.HandleUnknownHost(c.Writer, c.Request) {
+			c.String(http.StatusNotFound, "404 page not found")
+		}
+	})
 
 	pprof.Register(router)
 	return router
@@ -130,6 +185,26 @@ func (ws *Webserver) scan(c *gin.Context) error {
 	c.JSON(http.StatusOK, networks)
 	return nil
 }
+func (ws *Webserver) getState(c *gin.Context) {
+	current, since := ws.state.State()
+	c.JSON(http.StatusOK, gin.H{
+		"state":   current,
+		"since":   since,
+		"history": ws.state.History(),
+	})
+}
+
+// apClients lists the clients that got an address from us while in AP mode.
+func (ws *Webserver) apClients(c *gin.Context) error {
+	leases, err := ws.leases.Leases()
+	if err != nil {
+		return err
+	}
+
+	c.JSON(http.StatusOK, leases)
+	return nil
+}
+
 func (ws *Webserver) configureEthernetIP(c *gin.Context) error {
 	type respStruct struct {
 		IP      string
@@ -154,10 +229,13 @@ func (ws *Webserver) configureEthernetIP(c *gin.Context) error {
 	return nil
 }
 
-func (ws *Webserver) connect(c *gin.Context) error {
+func (ws *Webserver) getCountry(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"country": ws.ap.Country()})
+}
+
+func (ws *Webserver) setCountry(c *gin.Context) error {
 	type respStruct struct {
-		SSID string
-		PSK  string
+		Country string
 	}
 	resp := &respStruct{}
 	err := c.BindJSON(resp)
@@ -165,10 +243,173 @@ func (ws *Webserver) connect(c *gin.Context) error {
 		return err
 	}
 
-	err = ws.ap.ConnectToNetwork(resp.SSID, resp.PSK)
+	err = ws.ap.SetCountry(resp.Country)
+	if err != nil {
+		return err
+	}
+
+	c.JSON(http.StatusOK, gin.H{"country": ws.ap.Country()})
+	return nil
+}
+
+// connect starts a connection attempt in the background since the client most likely loses its
+// connection to our AP while we try. Progress is polled using the returned job id.
+func (ws *Webserver) connect(c *gin.Context) error {
+	cfg := ap.NetworkConfig{}
+	err := c.BindJSON(&cfg)
+	if err != nil {
+		return err
+	}
+
+	job, err := ws.jobs.New(cfg.SSID)
+	if err != nil {
+		return err
+	}
+
+	ws.running.Add(1)
+	go func() {
+		defer ws.running.Done()
+		ws.runConnect(ws.ctx, job.ID, cfg)
+	}()
+
+	c.JSON(http.StatusOK, job)
+	return nil
+}
+
+func (ws *Webserver) runConnect(ctx context.Context, id string, cfg ap.NetworkConfig) {
+	progress := func(phase jobs.Phase) {
+		ws.jobs.SetPhase(id, phase)
+	}
+
+	err := ws.ap.ConnectToNetwork(ctx, cfg, progress)
+	if err == nil {
+		progress(jobs.PhaseObtainingDHCP)
+		_, err = ws.ap.WaitForAddress(ctx)
+	}
+	if err == nil && ws.prober.HasAliveURL() {
+		progress(jobs.PhaseVerifying)
+		err = ws.verifyAlive(ctx)
+	}
+	if errors.Is(err, context.Canceled) {
+		logrus.Infof("connecting to %s was cancelled", cfg.SSID)
+	} else if err != nil {
+		logrus.Errorf("failed to connect to %s: %s", cfg.SSID, err)
+	}
+
+	err = ws.jobs.Finish(id, err)
+	if err != nil {
+		logrus.Errorf("error saving jobs: %s", err)
+	}
+}
+
+// verifyAlive checks alive-url a few times since routes and DNS might not be ready directly after DHCP.
+func (ws *Webserver) verifyAlive(ctx context.Context) error {
+	var err error
+	for i := 0; i < 5; i++ {
+		var alive bool
+		alive, err = ws.prober.Alive()
+		if alive {
+			return nil
+		}
+		select {
+		case <-time.After(2 * time.Second):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("connected but alive-url is not reachable: %w", err)
+	}
+	return fmt.Errorf("connected but alive-url did not answer 200")
+}
+
+func (ws *Webserver) getJob(c *gin.Context) error {
+	job, ok := ws.jobs.Get(c.Param("id"))
+	if !ok {
+		return fmt.Errorf("job not found")
+	}
+
+	c.JSON(http.StatusOK, job)
+	return nil
+}
+
+// lastJob returns the latest connection attempt so the outcome can be shown when the portal is opened again.
+func (ws *Webserver) lastJob(c *gin.Context) {
+	job, ok := ws.jobs.Last()
+	if !ok {
+		c.JSON(http.StatusOK, gin.H{})
+		return
+	}
+
+	c.JSON(http.StatusOK, job)
+}
+
+func (ws *Webserver) listNetworks(c *gin.Context) error {
+	networks, err := ws.ap.SavedNetworks()
 	if err != nil {
 		logrus.Error(err)
-		return fmt.Errorf("failed to connect")
+		return fmt.Errorf("failed to list networks")
+	}
+
+	c.JSON(http.StatusOK, networks)
+	return nil
+}
+
+func (ws *Webserver) addNetwork(c *gin.Context) error {
+	cfg := ap.NetworkConfig{}
+	err := c.BindJSON(&cfg)
+	if err != nil {
+		return err
+	}
+
+	id, err := ws.ap.AddNetwork(cfg)
+	if err != nil {
+		return err
+	}
+
+	c.JSON(http.StatusOK, gin.H{"id": id})
+	return nil
+}
+
+func (ws *Webserver) updateNetwork(c *gin.Context) error {
+	cfg := ap.NetworkConfig{}
+	err := c.BindJSON(&cfg)
+	if err != nil {
+		return err
+	}
+
+	err = ws.ap.UpdateNetwork(c.Param("id"), cfg)
+	if err != nil {
+		return err
+	}
+
+	c.JSON(http.StatusOK, gin.H{})
+	return nil
+}
+
+func (ws *Webserver) reorderNetworks(c *gin.Context) error {
+	type respStruct struct {
+		IDs []string
+	}
+	resp := &respStruct{}
+	err := c.BindJSON(resp)
+	if err != nil {
+		return err
+	}
+
+	err = ws.ap.ReorderNetworks(resp.IDs)
+	if err != nil {
+		return err
+	}
+
+	c.JSON(http.StatusOK, gin.H{})
+	return nil
+}
+
+func (ws *Webserver) removeNetwork(c *gin.Context) error {
+	err := ws.ap.RemoveNetwork(c.Param("id"))
+	if err != nil {
+		return err
 	}
 
 	c.JSON(http.StatusOK, gin.H{})
@@ -176,31 +417,47 @@ func (ws *Webserver) connect(c *gin.Context) error {
 }
 
 func (ws *Webserver) Start(ctx context.Context) {
-	srv := &http.Server{
-		ReadTimeout:       10 * time.Second,
-		WriteTimeout:      10 * time.Second,
-		IdleTimeout:       30 * time.Second,
-		ReadHeaderTimeout: 2 * time.Second,
-		Addr:              ":" + ws.Port,
-		Handler:           ws.Init(),
+	ws.ctx = ctx
+	ports := []string{ws.Port}
+	if ws.PortalPort != "" && ws.PortalPort != ws.Port {
+		ports = append(ports, ws.PortalPort)
 	}
 
-	go func() {
-		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
-			logrus.Fatalf("error starting webserver %s", err)
+	handler := ws.Init()
+	servers := []*http.Server{}
+	for _, port := range ports {
+		srv := &http.Server{
+			ReadTimeout:       10 * time.Second,
+			WriteTimeout:      10 * time.Second,
+			IdleTimeout:       30 * time.Second,
+			ReadHeaderTimeout: 2 * time.Second,
+			Addr:              ":" + port,
+			Handler:           handler,
 		}
-	}()
+		servers = append(servers, srv)
+
+		go func() {
+			if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				logrus.Fatalf("error starting webserver %s", err)
+			}
+		}()
+	}
 
-	logrus.Debug("webserver started")
+	logrus.Debugf("webserver started on %v", ports)
 
 	<-ctx.Done()
 
 	ctxShutDown, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	if err := srv.Shutdown(ctxShutDown); !errors.Is(err, http.ErrServerClosed) && err != nil {
-		logrus.Error(err)
+	for _, srv := range servers {
+		if err := srv.Shutdown(ctxShutDown); !errors.Is(err, http.ErrServerClosed) && err != nil {
+			logrus.Error(err)
+		}
 	}
+
+	// let cancelled connect jobs record their outcome before we exit.
+	ws.running.Wait()
 }
 
 func err(f func(c *gin.Context) error) gin.HandlerFunc {
@@ -0,0 +1,118 @@
+package wpa
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	EventConnected         = "CTRL-EVENT-CONNECTED"
+	EventDisconnected      = "CTRL-EVENT-DISCONNECTED"
+	EventSSIDTempDisabled  = "CTRL-EVENT-SSID-TEMP-DISABLED"
+	EventAssocReject       = "CTRL-EVENT-ASSOC-REJECT"
+	EventNetworkNotFound   = "CTRL-EVENT-NETWORK-NOT-FOUND"
+	EventEAPFailure        = "CTRL-EVENT-EAP-FAILURE"
+	EventScanResults       = "CTRL-EVENT-SCAN-RESULTS"
+	EventScanFailed        = "CTRL-EVENT-SCAN-FAILED"
+	EventTerminating       = "CTRL-EVENT-TERMINATING"
+	EventAPEnabled         = "AP-ENABLED"
+	EventAPDisabled        = "AP-DISABLED"
+	EventAPStaConnected    = "AP-STA-CONNECTED"
+	EventAPStaDisconnected = "AP-STA-DISCONNECTED"
+)
+
+var pingInterval = 30 * time.Second
+
+// Event is an unsolicited message like "<3>CTRL-EVENT-CONNECTED - Connection to 44:d9:e7:f3:91:77 completed".
+type Event struct {
+	Level int
+	Name  string
+	Text  string
+}
+
+func parseEvent(msg string) *Event {
+	end := strings.IndexByte(msg, '>')
+	ev := &Event{Text: strings.TrimSpace(msg[end+1:])}
+	ev.Level, _ = strconv.Atoi(msg[1:end])
+	ev.Name, _, _ = strings.Cut(ev.Text, " ")
+	return ev
+}
+
+// Field returns the value of key=value in the event text, for example reason in
+// "CTRL-EVENT-SSID-TEMP-DISABLED id=1 ssid="house" auth_failures=1 duration=10 reason=WRONG_KEY".
+func (e *Event) Field(key string) string {
+	for _, f := range strings.Fields(e.Text) {
+		f = strings.Trim(f, "[]")
+		k, v, ok := strings.Cut(f, "=")
+		if ok && k == key {
+			return strings.Trim(v, "\"")
+		}
+	}
+	return ""
+}
+
+// Events attaches to the control interface and calls fn for every unsolicited event
+// until ctx is cancelled or wpa_supplicant stops answering. The client should not be
+// used for other requests while attached.
+func (c *Client) Events(ctx context.Context, fn func(*Event)) error {
+	err := c.Attach()
+	if err != nil {
+		return err
+	}
+	return c.Listen(ctx, fn)
+}
+
+func (c *Client) Attach() error {
+	return c.requestOK("ATTACH")
+}
+
+// Listen calls fn for every event after Attach, see Events.
+func (c *Client) Listen(ctx context.Context, fn func(*Event)) error {
+	stop := context.AfterFunc(ctx, func() {
+		_ = c.conn.Close() // unblocks Read
+	})
+	defer stop()
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	pingSent := false
+	buf := make([]byte, 16384)
+	for {
+		err := c.conn.SetReadDeadline(time.Now().Add(pingInterval))
+		if err != nil {
+			return err
+		}
+		n, err := c.conn.Read(buf)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			if pingSent {
+				return fmt.Errorf("wpa_supplicant did not answer PING")
+			}
+			// make sure wpa_supplicant is still there since we will not notice otherwise.
+			_, err = c.conn.Write([]byte("PING"))
+			if err != nil {
+				return fmt.Errorf("error sending PING: %w", err)
+			}
+			pingSent = true
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("error reading event: %w", err)
+		}
+
+		msg := string(buf[:n])
+		if !isEvent(msg) {
+			pingSent = false // PONG
+			continue
+		}
+		fn(parseEvent(msg))
+	}
+}
@@ -0,0 +1,352 @@
+package wpa
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const DefaultCtrlDir = "/var/run/wpa_supplicant"
+
+var ErrFail = errors.New("wpa_supplicant replied FAIL")
+
+// ErrBusy is the FAIL-BUSY reply, for example to SCAN while a scan is running.
+var ErrBusy = fmt.Errorf("%w-BUSY", ErrFail)
+
+var counter atomic.Uint64
+
+// Client talks to the wpa_supplicant control interface over its unix datagram socket.
+type Client struct {
+	conn    *net.UnixConn
+	local   string
+	Timeout time.Duration
+
+	mutex sync.Mutex
+}
+
+// Dial connects to the control socket of iface located in ctrlDir.
+func Dial(ctrlDir, iface string) (*Client, error) {
+	local := filepath.Join(os.TempDir(), fmt.Sprintf("wificonfig_wpa_ctrl_%d-%d", os.Getpid(), counter.Add(1)))
+	_ = os.Remove(local)
+
+	laddr := &net.UnixAddr{Name: local, Net: "unixgram"}
+	raddr := &net.UnixAddr{Name: filepath.Join(ctrlDir, iface), Net: "unixgram"}
+	conn, err := net.DialUnix("unixgram", laddr, raddr)
+	if err != nil {
+		_ = os.Remove(local)
+		return nil, fmt.Errorf("error connecting to wpa_supplicant control socket %s: %w", raddr.Name, err)
+	}
+
+	return &Client{
+		conn:    conn,
+		local:   local,
+		Timeout: 10 * time.Second,
+	}, nil
+}
+
+func (c *Client) Close() error {
+	err := c.conn.Close()
+	_ = os.Remove(c.local)
+	return err
+}
+
+// Request sends cmd and returns the raw reply. Unsolicited event messages are skipped.
+func (c *Client) Request(cmd string) (string, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	err := c.conn.SetDeadline(time.Now().Add(c.Timeout))
+	if err != nil {
+		return "", err
+	}
+
+	_, err = c.conn.Write([]byte(cmd))
+	if err != nil {
+		return "", fmt.Errorf("error sending %s: %w", cmd, err)
+	}
+
+	buf := make([]byte, 16384)
+	for {
+		n, err := c.conn.Read(buf)
+		if err != nil {
+			return "", fmt.Errorf("error reading reply to %s: %w", cmd, err)
+		}
+		reply := string(buf[:n])
+		if isEvent(reply) {
+			continue
+		}
+		return reply, nil
+	}
+}
+
+func (c *Client) requestOK(cmd string) error {
+	reply, err := c.Request(cmd)
+	if err != nil {
+		return err
+	}
+	reply = strings.TrimSpace(reply)
+	if reply == "OK" {
+		return nil
+	}
+	if reply == "FAIL-BUSY" {
+		return fmt.Errorf("%s: %w", cmd, ErrBusy)
+	}
+	if strings.HasPrefix(reply, "FAIL") {
+		return fmt.Errorf("%s: %w (%s)", cmd, ErrFail, reply)
+	}
+	return fmt.Errorf("%s: expected OK got: %s", cmd, reply)
+}
+
+func (c *Client) Ping() error {
+	reply, err := c.Request("PING")
+	if err != nil {
+		return err
+	}
+	if strings.TrimSpace(reply) != "PONG" {
+		return fmt.Errorf("PING: expected PONG got: %s", reply)
+	}
+	return nil
+}
+
+type Status struct {
+	WpaState  string
+	Mode      string
+	SSID      string
+	BSSID     string
+	Frequency int
+	IPAddress string
+	KeyMgmt   string
+	Fields    map[string]string
+}
+
+func (c *Client) Status() (*Status, error) {
+	reply, err := c.Request("STATUS")
+	if err != nil {
+		return nil, err
+	}
+	return parseStatus(reply), nil
+}
+
+func parseStatus(reply string) *Status {
+	s := &Status{Fields: parseKeyValue(reply)}
+	s.WpaState = s.Fields["wpa_state"]
+	s.Mode = s.Fields["mode"]
+	s.SSID = s.Fields["ssid"]
+	s.BSSID = s.Fields["bssid"]
+	s.IPAddress = s.Fields["ip_address"]
+	s.KeyMgmt = s.Fields["key_mgmt"]
+	s.Frequency, _ = strconv.Atoi(s.Fields["freq"])
+	return s
+}
+
+func parseKeyValue(reply string) map[string]string {
+	fields := make(map[string]string)
+	for _, line := range strings.Split(reply, "\n") {
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			continue
+		}
+		fields[key] = value
+	}
+	return fields
+}
+
+// Set changes a global wpa_supplicant variable like country at runtime.
+func (c *Client) Set(variable, value string) error {
+	return c.requestOK(fmt.Sprintf("SET %s %s", variable, value))
+}
+
+func (c *Client) Scan() error {
+	return c.requestOK("SCAN")
+}
+
+type ScanResult struct {
+	BSSID       string
+	Frequency   int
+	SignalLevel int
+	Flags       string
+	SSID        string
+}
+
+func (c *Client) ScanResults() ([]*ScanResult, error) {
+	reply, err := c.Request("SCAN_RESULTS")
+	if err != nil {
+		return nil, err
+	}
+	return parseScanResults(reply), nil
+}
+
+// parseScanResults parses the tab separated SCAN_RESULTS reply:
+// bssid / frequency / signal level / flags / ssid.
+func parseScanResults(reply string) []*ScanResult {
+	results := []*ScanResult{}
+	lines := strings.Split(reply, "\n")
+	for _, line := range lines[1:] {
+		fields := strings.SplitN(line, "\t", 5)
+		if len(fields) < 4 {
+			continue
+		}
+		r := &ScanResult{
+			BSSID: fields[0],
+			Flags: fields[3],
+		}
+		r.Frequency, _ = strconv.Atoi(fields[1])
+		r.SignalLevel, _ = strconv.Atoi(fields[2])
+		if len(fields) == 5 {
+			r.SSID = fields[4]
+		}
+		results = append(results, r)
+	}
+	return results
+}
+
+type Network struct {
+	ID       string
+	SSID     string
+	BSSID    string
+	Flags    string
+	Current  bool
+	Disabled bool
+}
+
+func (c *Client) ListNetworks() ([]*Network, error) {
+	reply, err := c.Request("LIST_NETWORKS")
+	if err != nil {
+		return nil, err
+	}
+	return parseListNetworks(reply), nil
+}
+
+// parseListNetworks parses the tab separated LIST_NETWORKS reply:
+// network id / ssid / bssid / flags.
+func parseListNetworks(reply string) []*Network {
+	networks := []*Network{}
+	lines := strings.Split(reply, "\n")
+	for _, line := range lines[1:] {
+		fields := strings.Split(line, "\t")
+		if len(fields) < 2 {
+			continue
+		}
+		n := &Network{
+			ID:   fields[0],
+			SSID: fields[1],
+		}
+		if len(fields) > 2 {
+			n.BSSID = fields[2]
+		}
+		if len(fields) > 3 {
+			n.Flags = fields[3]
+			n.Current = strings.Contains(n.Flags, "[CURRENT]")
+			n.Disabled = strings.Contains(n.Flags, "[DISABLED]")
+		}
+		networks = append(networks, n)
+	}
+	return networks
+}
+
+func (c *Client) AddNetwork() (string, error) {
+	reply, err := c.Request("ADD_NETWORK")
+	if err != nil {
+		return "", err
+	}
+	id := strings.TrimSpace(reply)
+	if _, err := strconv.Atoi(id); err != nil {
+		return "", fmt.Errorf("ADD_NETWORK: expected network id got: %s", reply)
+	}
+	return id, nil
+}
+
+func (c *Client) RemoveNetwork(id string) error {
+	return c.requestOK("REMOVE_NETWORK " + id)
+}
+
+// SetNetwork sets variable on network id. value must already be quoted if wpa_supplicant expects a string.
+func (c *Client) SetNetwork(id, variable, value string) error {
+	return c.requestOK(fmt.Sprintf("SET_NETWORK %s %s %s", id, variable, value))
+}
+
+func (c *Client) GetNetwork(id, variable string) (string, error) {
+	reply, err := c.Request(fmt.Sprintf("GET_NETWORK %s %s", id, variable))
+	if err != nil {
+		return "", err
+	}
+	if strings.HasPrefix(reply, "FAIL") {
+		return "", fmt.Errorf("GET_NETWORK %s %s: %w", id, variable, ErrFail)
+	}
+	return reply, nil
+}
+
+func (c *Client) EnableNetwork(id string) error {
+	return c.requestOK("ENABLE_NETWORK " + id)
+}
+
+func (c *Client) DisableNetwork(id string) error {
+	return c.requestOK("DISABLE_NETWORK " + id)
+}
+
+func (c *Client) SelectNetwork(id string) error {
+	return c.requestOK("SELECT_NETWORK " + id)
+}
+
+func (c *Client) SaveConfig() error {
+	return c.requestOK("SAVE_CONFIG")
+}
+
+func (c *Client) Reconfigure() error {
+	return c.requestOK("RECONFIGURE")
+}
+
+func (c *Client) Reassociate() error {
+	return c.requestOK("REASSOCIATE")
+}
+
+func (c *Client) Disconnect() error {
+	return c.requestOK("DISCONNECT")
+}
+
+// Quote returns s as a wpa_supplicant string value. Printable ASCII without quotes is quoted, anything else is
+// hex encoded so it can neither break the command nor the line in the config file.
+func Quote(s string) string {
+	for _, c := range []byte(s) {
+		if c < 0x20 || c > 0x7e || c == '"' {
+			return hex.EncodeToString([]byte(s))
+		}
+	}
+	return "\"" + s + "\""
+}
+
+// QuotePassphrase returns a WPA passphrase as psk value. Unlike other strings a psk cannot be hex encoded, that
+// is the derived key, so the passphrase must be checked to be printable ASCII before. Quotes inside are fine
+// since wpa_supplicant reads up to the last quote.
+func QuotePassphrase(passphrase string) string {
+	return "\"" + passphrase + "\""
+}
+
+// Unquote returns the string of a quoted or hex encoded value like from GET_NETWORK.
+func Unquote(value string) string {
+	value = strings.TrimSpace(value)
+	if len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"' {
+		return value[1 : len(value)-1]
+	}
+	if b, err := hex.DecodeString(value); err == nil {
+		return string(b)
+	}
+	return value
+}
+
+// isEvent reports if msg is an unsolicited message like "<3>CTRL-EVENT-CONNECTED ...".
+func isEvent(msg string) bool {
+	if len(msg) < 3 || msg[0] != '<' {
+		return false
+	}
+	i := strings.IndexByte(msg, '>')
+	return i > 1 && i < 4
+}
@@ -0,0 +1,179 @@
+package wpa
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/nergy-se/wificonfig/pkg/wpa/wpatest"
+)
+
+func dialFake(t *testing.T, replies map[string][]string) (*Client, *wpatest.Server) {
+	s := wpatest.NewServer(t, "wlan0", wpatest.Replies(replies))
+	c, err := Dial(s.Dir, "wlan0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		c.Close()
+	})
+	return c, s
+}
+
+func TestStatus(t *testing.T) {
+	c, _ := dialFake(t, map[string][]string{
+		"STATUS": {`bssid=44:d9:e7:f3:91:77
+freq=2462
+ssid=Hokage24
+id=1
+mode=station
+pairwise_cipher=CCMP
+key_mgmt=WPA2-PSK
+wpa_state=COMPLETED
+ip_address=192.168.1.20
+address=dc:a6:32:00:00:01
+`},
+	})
+
+	status, err := c.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.WpaState != "COMPLETED" || status.Mode != "station" || status.SSID != "Hokage24" {
+		t.Errorf("unexpected status: %+v", status)
+	}
+	if status.Frequency != 2462 || status.IPAddress != "192.168.1.20" || status.KeyMgmt != "WPA2-PSK" {
+		t.Errorf("unexpected status: %+v", status)
+	}
+}
+
+func TestScanResults(t *testing.T) {
+	c, _ := dialFake(t, map[string][]string{
+		"SCAN_RESULTS": {"bssid / frequency / signal level / flags / ssid\n" +
+			"18:e8:29:c2:8f:84\t5180\t-63\t[WPA2-PSK-CCMP][ESS]\tHokage 5\n" +
+			"56:d9:e7:f3:91:77\t2462\t-57\t[WPA2-PSK-CCMP][ESS]\t\n"},
+	})
+
+	results, err := c.ScanResults()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 2 {
+		t.Fatalf("expected 2 results got %d", len(results))
+	}
+	expected := ScanResult{
+		BSSID:       "18:e8:29:c2:8f:84",
+		Frequency:   5180,
+		SignalLevel: -63,
+		Flags:       "[WPA2-PSK-CCMP][ESS]",
+		SSID:        "Hokage 5",
+	}
+	if *results[0] != expected {
+		t.Errorf("expected %+v got %+v", expected, *results[0])
+	}
+	if results[1].SSID != "" {
+		t.Errorf("expected empty ssid got %s", results[1].SSID)
+	}
+}
+
+func TestListNetworks(t *testing.T) {
+	c, _ := dialFake(t, map[string][]string{
+		"LIST_NETWORKS": {"network id / ssid / bssid / flags\n" +
+			"0\tnergy-setup\tany\t[DISABLED]\n" +
+			"1\thouse\tany\t[CURRENT]\n"},
+	})
+
+	networks, err := c.ListNetworks()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(networks) != 2 {
+		t.Fatalf("expected 2 networks got %d", len(networks))
+	}
+	if networks[0].SSID != "nergy-setup" || !networks[0].Disabled {
+		t.Errorf("unexpected network: %+v", networks[0])
+	}
+	if networks[1].ID != "1" || !networks[1].Current {
+		t.Errorf("unexpected network: %+v", networks[1])
+	}
+}
+
+func TestRequestSkipsEvents(t *testing.T) {
+	c, _ := dialFake(t, map[string][]string{
+		"PING": {"<3>CTRL-EVENT-SCAN-STARTED ", "PONG\n"},
+	})
+
+	err := c.Ping()
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSetNetwork(t *testing.T) {
+	c, s := dialFake(t, map[string][]string{
+		`SET_NETWORK 1 ssid "house"`: {"OK\n"},
+		"SET_NETWORK 1 psk short":    {"FAIL\n"},
+	})
+
+	err := c.SetNetwork("1", "ssid", Quote("house"))
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = c.SetNetwork("1", "psk", "short")
+	if !errors.Is(err, ErrFail) {
+		t.Errorf("expected ErrFail got %v", err)
+	}
+
+	received := s.Received()
+	if len(received) != 2 || received[0] != `SET_NETWORK 1 ssid "house"` || !strings.HasPrefix(received[1], "SET_NETWORK 1 psk") {
+		t.Errorf("unexpected commands received: %v", received)
+	}
+}
+
+func TestEvents(t *testing.T) {
+	c, _ := dialFake(t, map[string][]string{
+		"ATTACH": {"OK\n", "<3>CTRL-EVENT-CONNECTED - Connection to 44:d9:e7:f3:91:77 completed [id=1 id_str=]"},
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var events []*Event
+	err := c.Events(ctx, func(ev *Event) {
+		events = append(events, ev)
+		cancel()
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context.Canceled got %v", err)
+	}
+	if len(events) != 1 {
+		t.Fatalf("expected 1 event got %d", len(events))
+	}
+	if events[0].Level != 3 || events[0].Name != EventConnected {
+		t.Errorf("unexpected event: %+v", events[0])
+	}
+}
+
+func TestQuote(t *testing.T) {
+	tests := []struct {
+		s        string
+		expected string
+	}{
+		{"house", `"house"`},
+		{"my house 5G", `"my house 5G"`},
+		{`say "hi"`, "7361792022686922"},
+		{"two\nlines", "74776f0a6c696e6573"},
+		{"kafé", "6b6166c3a9"},
+	}
+	for _, tt := range tests {
+		got := Quote(tt.s)
+		if got != tt.expected {
+			t.Errorf("%q: expected %s got %s", tt.s, tt.expected, got)
+		}
+		if Unquote(got) != tt.s {
+			t.Errorf("%q: expected unquote to return it got %q", tt.s, Unquote(got))
+		}
+	}
+}
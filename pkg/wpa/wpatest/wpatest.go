@@ -0,0 +1,262 @@
+// Package wpatest provides a fake wpa_supplicant control socket for tests.
+package wpatest
+
+import (
+	"fmt"
+	"maps"
+	"net"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// Handler returns the messages sent in reply to cmd. Events can be sent before the actual reply.
+type Handler func(cmd string) []string
+
+// Server is a fake control socket for one interface, dial it with wpa.Dial(s.Dir, iface).
+type Server struct {
+	Dir string
+
+	conn    *net.UnixConn
+	handler Handler
+
+	mutex    sync.Mutex
+	received []string
+	attached []*net.UnixAddr
+}
+
+// NewServer starts a fake control socket for iface in a temp dir. It is closed when the test ends.
+func NewServer(t testing.TB, iface string, handler Handler) *Server {
+	dir := t.TempDir()
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: filepath.Join(dir, iface), Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &Server{Dir: dir, conn: conn, handler: handler}
+	go s.serve()
+	t.Cleanup(func() {
+		conn.Close()
+	})
+	return s
+}
+
+func (s *Server) serve() {
+	buf := make([]byte, 4096)
+	for {
+		n, addr, err := s.conn.ReadFromUnix(buf)
+		if err != nil {
+			return
+		}
+		cmd := string(buf[:n])
+		s.mutex.Lock()
+		s.received = append(s.received, cmd)
+		if cmd == "ATTACH" {
+			s.attached = append(s.attached, addr)
+		}
+		s.mutex.Unlock()
+
+		for _, r := range s.handler(cmd) {
+			_, _ = s.conn.WriteToUnix([]byte(r), addr)
+		}
+	}
+}
+
+// Received returns all commands received so far.
+func (s *Server) Received() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]string{}, s.received...)
+}
+
+// Event sends msg, like "<3>CTRL-EVENT-CONNECTED ...", to every client that sent ATTACH.
+func (s *Server) Event(msg string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, addr := range s.attached {
+		_, _ = s.conn.WriteToUnix([]byte(msg), addr)
+	}
+}
+
+// Replies returns a Handler sending every reply listed for a command in order. Unlisted commands get
+// UNKNOWN COMMAND like from wpa_supplicant.
+func Replies(replies map[string][]string) Handler {
+	return func(cmd string) []string {
+		r, ok := replies[cmd]
+		if !ok {
+			return []string{"UNKNOWN COMMAND\n"}
+		}
+		return r
+	}
+}
+
+// Networks emulates the network block commands of wpa_supplicant on networks kept in memory. RECONFIGURE
+// restores the networks as they were at the last SAVE_CONFIG.
+type Networks struct {
+	// ScanResults is the reply to SCAN_RESULTS.
+	ScanResults string
+
+	networks map[int]map[string]string
+	saved    map[int]map[string]string
+	nextID   int
+
+	mutex sync.Mutex
+}
+
+func NewNetworks() *Networks {
+	return &Networks{networks: map[int]map[string]string{}, saved: map[int]map[string]string{}}
+}
+
+// Add adds an enabled network with variables set as they would be in SET_NETWORK and saves it. It returns the id.
+func (n *Networks) Add(variables map[string]string) string {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	id := n.nextID
+	n.nextID++
+	n.networks[id] = maps.Clone(variables)
+	n.saved = cloneNetworks(n.networks)
+	return strconv.Itoa(id)
+}
+
+// Get returns variable of network id.
+func (n *Networks) Get(id, variable string) (string, bool) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	i, _ := strconv.Atoi(id)
+	v, ok := n.networks[i][variable]
+	return v, ok
+}
+
+// IDs returns the ids of all networks.
+func (n *Networks) IDs() []string {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	ids := []string{}
+	for _, i := range n.sortedIDs() {
+		ids = append(ids, strconv.Itoa(i))
+	}
+	return ids
+}
+
+func (n *Networks) sortedIDs() []int {
+	ids := []int{}
+	for id := range n.networks {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	return ids
+}
+
+// Handle implements Handler.
+func (n *Networks) Handle(cmd string) []string {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	fields := strings.SplitN(cmd, " ", 4)
+	network := func() map[string]string {
+		if len(fields) < 2 {
+			return nil
+		}
+		id, err := strconv.Atoi(fields[1])
+		if err != nil {
+			return nil
+		}
+		return n.networks[id]
+	}
+
+	switch fields[0] {
+	case "LIST_NETWORKS":
+		reply := "network id / ssid / bssid / flags\n"
+		for _, id := range n.sortedIDs() {
+			flags := ""
+			if n.networks[id]["disabled"] == "1" {
+				flags = "[DISABLED]"
+			}
+			reply += fmt.Sprintf("%d\t%s\tany\t%s\n", id, strings.Trim(n.networks[id]["ssid"], `"`), flags)
+		}
+		return []string{reply}
+	case "ADD_NETWORK":
+		id := n.nextID
+		n.nextID++
+		n.networks[id] = map[string]string{"disabled": "1"}
+		return []string{fmt.Sprintf("%d\n", id)}
+	case "SET_NETWORK":
+		nw := network()
+		if nw == nil || len(fields) < 4 {
+			return []string{"FAIL\n"}
+		}
+		if fields[3] == "NULL" {
+			delete(nw, fields[2])
+		} else {
+			nw[fields[2]] = fields[3]
+		}
+	case "GET_NETWORK":
+		nw := network()
+		if nw == nil || len(fields) < 3 {
+			return []string{"FAIL\n"}
+		}
+		v, ok := nw[fields[2]]
+		if !ok {
+			v, ok = integerDefaults[fields[2]]
+		}
+		if !ok {
+			return []string{"FAIL\n"}
+		}
+		return []string{v}
+	case "ENABLE_NETWORK", "DISABLE_NETWORK":
+		nw := network()
+		if nw == nil {
+			return []string{"FAIL\n"}
+		}
+		nw["disabled"] = "0"
+		if fields[0] == "DISABLE_NETWORK" {
+			nw["disabled"] = "1"
+		}
+	case "SELECT_NETWORK":
+		nw := network()
+		if nw == nil {
+			return []string{"FAIL\n"}
+		}
+		for _, other := range n.networks {
+			other["disabled"] = "1"
+		}
+		nw["disabled"] = "0"
+	case "REMOVE_NETWORK":
+		nw := network()
+		if nw == nil {
+			return []string{"FAIL\n"}
+		}
+		id, _ := strconv.Atoi(fields[1])
+		delete(n.networks, id)
+	case "ATTACH", "DETACH":
+	case "SAVE_CONFIG":
+		n.saved = cloneNetworks(n.networks)
+	case "RECONFIGURE":
+		n.networks = cloneNetworks(n.saved)
+	case "SCAN_RESULTS":
+		return []string{n.ScanResults}
+	default:
+		return []string{"UNKNOWN COMMAND\n"}
+	}
+	return []string{"OK\n"}
+}
+
+// integerDefaults are returned by GET_NETWORK for integer variables that are not set, string variables fail.
+var integerDefaults = map[string]string{
+	"priority":  "0",
+	"scan_ssid": "0",
+	"mode":      "0",
+	"disabled":  "0",
+	"frequency": "0",
+}
+
+func cloneNetworks(networks map[int]map[string]string) map[int]map[string]string {
+	c := map[int]map[string]string{}
+	for id, nw := range networks {
+		c[id] = maps.Clone(nw)
+	}
+	return c
+}
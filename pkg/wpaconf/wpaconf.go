@@ -0,0 +1,246 @@
+// Package wpaconf reads and writes wpa_supplicant.conf files. Everything we do not touch, including comments,
+// blank lines and ordering, is written back exactly as it was read.
+package wpaconf
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Block is a `name={ ... }` section like network={ or cred={.
+type Block struct {
+	Name string
+	// Lines are the raw lines between the braces.
+	Lines []string
+}
+
+// Get returns the raw value of key, including quotes for string values.
+func (b *Block) Get(key string) (string, bool) {
+	for _, line := range b.Lines {
+		k, v, ok := cutKeyValue(line)
+		if ok && k == key {
+			return v, true
+		}
+	}
+	return "", false
+}
+
+// Set replaces the value of key or appends it if missing. value must already be quoted if it is a string.
+func (b *Block) Set(key, value string) {
+	for i, line := range b.Lines {
+		k, _, ok := cutKeyValue(line)
+		if ok && k == key {
+			b.Lines[i] = "\t" + key + "=" + value
+			return
+		}
+	}
+	b.Lines = append(b.Lines, "\t"+key+"="+value)
+}
+
+// Delete removes key from the block.
+func (b *Block) Delete(key string) {
+	lines := b.Lines[:0]
+	for _, line := range b.Lines {
+		k, _, ok := cutKeyValue(line)
+		if ok && k == key {
+			continue
+		}
+		lines = append(lines, line)
+	}
+	b.Lines = lines
+}
+
+// item is either a raw line outside of any block or a block.
+type item struct {
+	line  string
+	block *Block
+}
+
+// Config is a parsed wpa_supplicant.conf.
+type Config struct {
+	items []item
+}
+
+// Parse reads a wpa_supplicant config.
+func Parse(r io.Reader) (*Config, error) {
+	c := &Config{}
+	var current *Block
+	lineNo := 0
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		lineNo++
+		line := scanner.Text()
+		trimmed := strings.TrimSpace(line)
+
+		if current != nil {
+			if trimmed == "}" {
+				current = nil
+				continue
+			}
+			current.Lines = append(current.Lines, line)
+			continue
+		}
+
+		if name, ok := strings.CutSuffix(trimmed, "={"); ok && !strings.HasPrefix(trimmed, "#") {
+			current = &Block{Name: name}
+			c.items = append(c.items, item{block: current})
+			continue
+		}
+		c.items = append(c.items, item{line: line})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if current != nil {
+		return nil, fmt.Errorf("%s block is not closed at line %d", current.Name, lineNo)
+	}
+	return c, nil
+}
+
+// Load parses file.
+func Load(file string) (*Config, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return Parse(f)
+}
+
+// Bytes returns the config in wpa_supplicant.conf format.
+func (c *Config) Bytes() []byte {
+	buf := &bytes.Buffer{}
+	for _, it := range c.items {
+		if it.block == nil {
+			buf.WriteString(it.line + "\n")
+			continue
+		}
+		buf.WriteString(it.block.Name + "={\n")
+		for _, line := range it.block.Lines {
+			buf.WriteString(line + "\n")
+		}
+		buf.WriteString("}\n")
+	}
+	return buf.Bytes()
+}
+
+// Save writes the config to file atomically by writing to a temporary file in the same directory and renaming it.
+func (c *Config) Save(file string) error {
+	tmp, err := os.CreateTemp(filepath.Dir(file), "."+filepath.Base(file)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // no-op after a successful rename
+
+	_, err = tmp.Write(c.Bytes())
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+	err = tmp.Chmod(0600)
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+	err = tmp.Sync()
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+	err = tmp.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), file)
+}
+
+// Global returns the value of a global option. Only options before the first block are considered.
+func (c *Config) Global(key string) (string, bool) {
+	for _, it := range c.items {
+		if it.block != nil {
+			break
+		}
+		k, v, ok := cutKeyValue(it.line)
+		if ok && k == key {
+			return v, true
+		}
+	}
+	return "", false
+}
+
+// SetGlobal replaces a global option or adds it after the last global option if missing.
+func (c *Config) SetGlobal(key, value string) {
+	last := -1
+	for i, it := range c.items {
+		if it.block != nil {
+			break
+		}
+		k, _, ok := cutKeyValue(it.line)
+		if !ok {
+			continue
+		}
+		if k == key {
+			c.items[i].line = key + "=" + value
+			return
+		}
+		last = i
+	}
+	c.items = append(c.items[:last+1], append([]item{{line: key + "=" + value}}, c.items[last+1:]...)...)
+}
+
+// Networks returns the network blocks in file order. Changing them changes the config.
+func (c *Config) Networks() []*Block {
+	var networks []*Block
+	for _, it := range c.items {
+		if it.block != nil && it.block.Name == "network" {
+			networks = append(networks, it.block)
+		}
+	}
+	return networks
+}
+
+// APNetwork returns the first network with mode=2 (access point) or nil if there is none.
+func (c *Config) APNetwork() *Block {
+	for _, n := range c.Networks() {
+		if mode, _ := n.Get("mode"); mode == "2" {
+			return n
+		}
+	}
+	return nil
+}
+
+// AddNetwork appends a network block separated by a blank line.
+func (c *Config) AddNetwork(b *Block) {
+	if n := len(c.items); n > 0 && (c.items[n-1].block != nil || strings.TrimSpace(c.items[n-1].line) != "") {
+		c.items = append(c.items, item{line: ""})
+	}
+	b.Name = "network"
+	c.items = append(c.items, item{block: b})
+}
+
+// Quote returns s as a quoted string value.
+func Quote(s string) string {
+	return "\"" + s + "\""
+}
+
+// Unquote removes the quotes from a string value. Unquoted values like hex or constants are returned as is.
+func Unquote(s string) string {
+	if len(s) >= 2 && s[0] == '"' && s[len(s)-1] == '"' {
+		return s[1 : len(s)-1]
+	}
+	return s
+}
+
+// cutKeyValue splits a `key=value` line. Comments and blank lines are not key/value pairs.
+func cutKeyValue(line string) (string, string, bool) {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return "", "", false
+	}
+	return strings.Cut(line, "=")
+}
@@ -0,0 +1,125 @@
+package wpaconf
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const config = `ctrl_interface=/var/run/wpa_supplicant
+ctrl_interface_group=0
+update_config=1
+country=SE
+ap_scan=1
+
+# our setup AP
+network={
+	ssid="nergy-setup"
+	psk="secret123"
+	key_mgmt=WPA-PSK
+	mode=2
+	frequency=2437
+}
+
+network={
+	ssid="house = home"
+	psk="password"
+	priority=11
+}
+
+cred={
+	realm="example.com"
+}
+`
+
+func TestRoundTrip(t *testing.T) {
+	cfg, err := Parse(strings.NewReader(config))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(cfg.Bytes()); got != config {
+		t.Errorf("expected:\n%s\ngot:\n%s", config, got)
+	}
+
+	networks := cfg.Networks()
+	if len(networks) != 2 {
+		t.Fatalf("expected 2 networks got %d", len(networks))
+	}
+	if ssid, _ := networks[1].Get("ssid"); Unquote(ssid) != "house = home" {
+		t.Errorf("unexpected ssid %s", ssid)
+	}
+	if country, _ := cfg.Global("country"); country != "SE" {
+		t.Errorf("expected country SE got %s", country)
+	}
+}
+
+func TestUpdateAPNetwork(t *testing.T) {
+	cfg, err := Parse(strings.NewReader(config))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ap := cfg.APNetwork()
+	if ap == nil {
+		t.Fatal("expected AP network")
+	}
+	ap.Set("ssid", Quote("new-setup"))
+	ap.Set("ieee80211w", "0")
+	ap.Delete("frequency")
+	cfg.SetGlobal("country", "NO")
+	cfg.SetGlobal("p2p_disabled", "1")
+
+	expected := strings.NewReplacer(
+		"country=SE\n", "country=NO\n",
+		"ap_scan=1\n", "ap_scan=1\np2p_disabled=1\n",
+		`ssid="nergy-setup"`, `ssid="new-setup"`,
+		"\tfrequency=2437\n", "\tieee80211w=0\n",
+	).Replace(config)
+	if got := string(cfg.Bytes()); got != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, got)
+	}
+}
+
+func TestAddNetworkAndSave(t *testing.T) {
+	cfg, err := Parse(strings.NewReader("update_config=1\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.APNetwork() != nil {
+		t.Fatal("expected no AP network")
+	}
+	n := &Block{}
+	n.Set("ssid", Quote("setup"))
+	n.Set("mode", "2")
+	cfg.AddNetwork(n)
+
+	fn := filepath.Join(t.TempDir(), "wpa_supplicant.conf")
+	err = cfg.Save(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := Load(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "update_config=1\n\nnetwork={\n\tssid=\"setup\"\n\tmode=2\n}\n"
+	if got := string(loaded.Bytes()); got != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, got)
+	}
+	info, err := os.Stat(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("expected mode 0600 got %s", info.Mode().Perm())
+	}
+}
+
+func TestParseUnclosedBlock(t *testing.T) {
+	_, err := Parse(strings.NewReader("network={\n\tssid=\"x\"\n"))
+	if err == nil {
+		t.Error("expected error for unclosed block")
+	}
+}